@@ -0,0 +1,158 @@
+package main
+
+// associativeOps lists the binary operators whose chains can be
+// flattened by flattenChains.
+var associativeOps = []string{"+", "*", "&", "|", "^", "&&", "||"}
+
+// flattenChains rewrites every left-nested chain of the same operator
+// in tree n into a single flat list.  E.g., the tree for "a + b + c",
+// which is ((a + b) + c), becomes (a + b + c).  Only operators in ops
+// are flattened.  The flattened nodes are returned so that nestChains
+// can restore the usual nesting.  The caller must fix parent and depth
+// fields.
+func flattenChains(n *node, ops map[string]bool) []*node {
+	var chains []*node
+	var walk func(n *node)
+	walk = func(n *node) {
+		for _, c := range n.children {
+			walk(c)
+		}
+		op := chainOp(n)
+		if op == "" || !ops[op] {
+			return
+		}
+		left := n.children[0]
+		if chainOp(left) != op {
+			return
+		}
+		n.children = append(append([]*node{}, left.children...), n.children[1:]...)
+		for i, c := range chains {
+			if c == left {
+				// left is no longer in the tree.
+				chains = append(chains[:i], chains[i+1:]...)
+				break
+			}
+		}
+		chains = append(chains, n)
+	}
+	walk(n)
+	return chains
+}
+
+// chainOp returns the operator if n is a chain of operands separated by
+// the same operator, e.g., "a + b" or "a + b + c", and "" otherwise.
+func chainOp(n *node) string {
+	c := n.children
+	if len(c) < 3 || len(c)%2 == 0 {
+		return ""
+	}
+	op := ""
+	for i := 1; i < len(c); i += 2 {
+		if c[i].children != nil || !isLiteral(c[i].token) {
+			return ""
+		}
+		if op == "" {
+			op = c[i].token.text
+		} else if c[i].token.text != op {
+			return ""
+		}
+	}
+	return op
+}
+
+// nestChains restores the left-nested structure of chains flattened by
+// flattenChains, including operands spliced in by replacements.  Lists
+// that are no longer chains of a single operator are left alone.
+func nestChains(chains []*node) {
+	for _, n := range chains {
+		if chainOp(n) == "" || len(n.children) <= 3 {
+			continue
+		}
+		c := n.children
+		left := c[0]
+		for i := 1; i+3 < len(c); i += 2 {
+			left = &node{children: []*node{left, c[i], c[i+1]}}
+		}
+		n.children = []*node{left, c[len(c)-2], c[len(c)-1]}
+		fixFields(n, n.parent, n.depth)
+	}
+}
+
+// groupOperand returns the nodes to splice into a chain with operator
+// op in place of matched operands.  A replacement that is not itself a
+// chain of op is grouped into a single operand node so that it stays
+// together when the chain is nested again.  If its operators bind less
+// tightly than op, e.g., "x + y" in a chain of "*", it is also put in
+// parentheses so that the text keeps the meaning of the tree.
+func groupOperand(result []*node, op string) []*node {
+	if len(result) == 0 {
+		return result
+	}
+	g := &node{children: result}
+	if len(result) == 1 {
+		g = result[0]
+	}
+	if chainOp(g) == op {
+		return result
+	}
+	if operandPrec(g) <= binaryPrec[op] {
+		g = parenthesize(g)
+	} else if len(result) == 1 {
+		return result
+	}
+	return []*node{g}
+}
+
+// parenthesize returns a node that holds n in parentheses.  Spaces and
+// comments around n go outside the parentheses.
+func parenthesize(n *node) *node {
+	open := &node{token: token{ttype: OPENER, text: "("}, replaced: true}
+	close := &node{token: token{ttype: CLOSER, text: ")"}, replaced: true}
+	all := leaves(n)
+	first, last := all[0], all[len(all)-1]
+	open.token.prefix, first.token.prefix = first.token.prefix, nil
+	close.token.suffix, last.token.suffix = last.token.suffix, nil
+	return &node{children: []*node{open, n, close}}
+}
+
+// binaryPrec holds the precedence of binary operators.  Operators with
+// higher values bind more tightly.  The parts of a conditional
+// expression and the comma operator, which parser does not group, bind
+// least tightly.
+var binaryPrec = map[string]int{
+	",": 0, "?": 0, ":": 0,
+	"=": 1, "+=": 1, "-=": 1, "*=": 1, "/=": 1, "%=": 1,
+	"<<=": 1, ">>=": 1, "&=": 1, "^=": 1, "|=": 1,
+	"||": 2,
+	"&&": 3,
+	"|":  4,
+	"^":  5,
+	"&":  6,
+	"==": 7, "!=": 7,
+	"<": 8, "<=": 8, ">": 8, ">=": 8,
+	"<<": 9, ">>": 9,
+	"+": 10, "-": 10,
+	"*": 11, "/": 11, "%": 11,
+}
+
+// operandPrec returns the precedence of the loosest binary operator
+// that separates the children of n, or a value above every operator if
+// n is not such a list (e.g., a token, a call or a unary expression).
+func operandPrec(n *node) int {
+	const tight = 100
+	c := n.children
+	if len(c) < 3 || len(c)%2 == 0 {
+		return tight
+	}
+	prec := tight
+	for i := 1; i < len(c); i += 2 {
+		p, ok := binaryPrec[c[i].token.text]
+		if c[i].children != nil || !ok {
+			return tight
+		}
+		if p < prec {
+			prec = p
+		}
+	}
+	return prec
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestFlattenChains(t *testing.T) {
+	ops := map[string]bool{"+": true, "&&": true}
+	for _, c := range []struct {
+		input string
+		flat  string
+	}{
+		{"a + b + c + d", "([a] [+] [b] [+] [c] [+] [d])"},
+		{"a - b + c", "(([a] [-] [b]) [+] [c])"},
+		{"a * b * c", "(([a] [*] [b]) [*] [c])"},
+		{"f(a + b + c) && x && y", "(([f] [(] ([a] [+] [b] [+] [c]) [)]) [&&] [x] [&&] [y])"},
+	} {
+		n := parse([]byte(c.input))
+		before := n.String()
+		chains := flattenChains(n, ops)
+		fixFields(n, nil, 0)
+		if got := n.String(); got != c.flat {
+			t.Errorf("flattenChains(%q): got %s, expecting %s", c.input, got, c.flat)
+		}
+		nestChains(chains)
+		if got := n.String(); got != before {
+			t.Errorf("nestChains(%q): got %s, expecting %s", c.input, got, before)
+		}
+	}
+}
+
+func TestAssociative(t *testing.T) {
+	for _, c := range []struct {
+		subject     string
+		pattern     string
+		replacement string
+		output      string
+		tree        string
+	}{
+		{"a+b+c+d", "b + $y", "f($y)", "a+f(c)+d", "(([a] [+] ([f] [(] [c] [)])) [+] [d])"},
+		{"a+b+c+d", "$x + c", "g($x)", "a+g(b)+d", "(([a] [+] ([g] [(] [b] [)])) [+] [d])"},
+		{"a+b+c+d", "b + c", "c + b", "a+c + b+d", "((([a] [+] [c]) [+] [b]) [+] [d])"},
+		{"a*b*c*d", "b * c", "x + y", "a*(x + y)*d", "(([a] [*] ([(] ([x] [+] [y]) [)])) [*] [d])"},
+		{"a*b*c*d", "b * c", "x / y", "a*(x / y)*d", "(([a] [*] ([(] ([x] [/] [y]) [)])) [*] [d])"},
+		{"a+b+c+d", "b + c", "x * y", "a+x * y+d", "(([a] [+] ([x] [*] [y])) [+] [d])"},
+		{"a*b*f(p+q)*d", "b * f($x)", "$x", "a*(p+q)*d", "(([a] [*] ([(] ([p] [+] [q]) [)])) [*] [d])"},
+		{"a || b || c", "b", "x ? y : z", "a || (x ? y : z) || c", "(([a] [||] ([(] ([x] [?] [y] [:] [z]) [)])) [||] [c])"},
+		{"a+b+c", "a + b + c", "z", "z", "([z])"},
+	} {
+		r := &rule{pattern: parsePattern([]byte(c.pattern), ""), replacement: parsePattern([]byte(c.replacement), "")}
+		if err := r.addAssociative(""); err != nil {
+			t.Fatal(err)
+		}
+		sub := parse([]byte(c.subject))
+		replace(sub, r)
+		if got := string(sub.serialize()); got != c.output {
+			t.Errorf("replace %q by %q in %q: got %q, expecting %q", c.pattern, c.replacement, c.subject, got, c.output)
+		}
+		if got := sub.String(); got != c.tree {
+			t.Errorf("replace %q by %q in %q: got tree %s, expecting %s", c.pattern, c.replacement, c.subject, got, c.tree)
+		}
+	}
+}
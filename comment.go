@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// commentPattern matches the text of a comment against a pattern
+// comment such as "/* TODO($who) */".
+type commentPattern struct {
+	re    *regexp.Regexp
+	names []string // Variable bound by each sub-match of re
+}
+
+// spaceRun matches a run of spaces in quoted regexp text.
+var spaceRun = regexp.MustCompile(`[ \t\r\n]+`)
+
+// makeCommentPattern returns a pattern for comment text.  Variables
+// match any text, as little as possible.  A run of spaces matches any
+// run of spaces, and spaces next to the comment delimiters are
+// optional.
+func makeCommentPattern(text string) *commentPattern {
+	c := &commentPattern{}
+	open, body, close := splitComment(trimComment(text))
+	var buf bytes.Buffer
+	buf.WriteString(`(?s)^`)
+	buf.WriteString(regexp.QuoteMeta(open))
+	buf.WriteString(`\s*`)
+	pieces, isVar := splitText(strings.TrimSpace(body))
+	for i, piece := range pieces {
+		if isVar[i] {
+			c.names = append(c.names, wordVarName(piece))
+			buf.WriteString("(.*?)")
+			continue
+		}
+		buf.WriteString(spaceRun.ReplaceAllString(regexp.QuoteMeta(piece), `\s+`))
+	}
+	buf.WriteString(`\s*`)
+	buf.WriteString(regexp.QuoteMeta(close))
+	buf.WriteString("$")
+	c.re = regexp.MustCompile(buf.String())
+	return c
+}
+
+// splitComment splits comment text into its opening delimiter, body and
+// closing delimiter (empty for line comments).
+func splitComment(text string) (open, body, close string) {
+	switch {
+	case strings.HasPrefix(text, "/*") && strings.HasSuffix(text, "*/") && len(text) >= 4:
+		return "/*", text[2 : len(text)-2], "*/"
+	case strings.HasPrefix(text, "//"):
+		return "//", text[2:], ""
+	}
+	return "", text, ""
+}
+
+// match returns a match that binds the variables of c if comment text
+// matches c.
+func (c *commentPattern) match(comment token) (match, bool) {
+	text := trimComment(comment.text)
+	m := c.re.FindStringSubmatchIndex(text)
+	if m == nil {
+		return match{}, false
+	}
+	result := match{vars: make(map[string][]*node)}
+	for i, name := range c.names {
+		if isAnonymous(name) {
+			continue
+		}
+		start, limit := m[2*(i+1)], m[2*(i+1)+1]
+		part := token{
+			ttype:  WORD,
+			line:   comment.line,
+			column: comment.column + start,
+			text:   text[start:limit],
+		}
+		result.vars[name] = []*node{&node{token: part}}
+	}
+	return result, true
+}
+
+// trimComment returns comment text without the newline that ends a
+// line comment.
+func trimComment(text string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")
+}
+
+// findComments calls fn for every comment attached to a token of tree
+// n.  Comments are visited in order.
+func findComments(n *node, fn func(list []token, i int)) {
+	perNode(n, func(c *node) {
+		if c.children != nil {
+			return
+		}
+		for _, list := range [][]token{c.token.prefix, c.token.suffix} {
+			for i, t := range list {
+				if t.ttype == COMMENT {
+					fn(list, i)
+				}
+			}
+		}
+	})
+}
+
+// commentRule returns the comment if pattern consists of nothing but
+// a single comment, which makes the rule rewrite comments instead of
+// code.
+func commentRule(pattern *node) (token, bool) {
+	var comments []token
+	code := false
+	perNode(pattern, func(c *node) {
+		if c.children != nil {
+			return
+		}
+		if c.token.ttype != END {
+			code = true
+		}
+		for _, t := range append(append([]token{}, c.token.prefix...), c.token.suffix...) {
+			if t.ttype == COMMENT {
+				comments = append(comments, t)
+			}
+		}
+	})
+	if code || len(comments) != 1 {
+		return token{}, false
+	}
+	return comments[0], true
+}
+
+// replaceComments replaces every comment in subject that matches the
+// comment pattern of r by the comment in r's replacement, or deletes
+// it if the replacement is empty.  The newline that ends a line comment
+// is kept, and a line comment that replaces a comment followed by code
+// starts a new line for the code.  It returns the number of comments
+// replaced.
+func replaceComments(subject *node, r *rule, pattern token) int {
+	pat := makeCommentPattern(pattern.text)
+	replacement, hasReplacement := commentRule(r.replacement)
+	count := 0
+	seq := textTokens(subject)
+	for k, t := range seq {
+		if t.ttype != COMMENT {
+			continue
+		}
+		m, ok := pat.match(*t)
+		if !ok || !r.accept(m) || !r.inLines(nil, *t) {
+			continue
+		}
+		count++
+		if !hasReplacement {
+			deleteComment(seq, k)
+			continue
+		}
+		newline := strings.HasSuffix(t.text, "\n")
+		text := ""
+		pieces, isVar := splitText(trimComment(replacement.text))
+		for j, piece := range pieces {
+			if isVar[j] {
+				piece = m.refText(piece)
+			}
+			text += piece
+		}
+		switch {
+		case newline:
+			text += "\n"
+		case !strings.HasPrefix(text, "//"):
+		case atLineEnd(seq, k):
+			trimAfter(seq, k, false)
+		default:
+			// A line comment must end its line, so the code
+			// after it moves to a new line with the same
+			// indentation.
+			text += "\n" + indentAt(seq, k)
+			trimAfter(seq, k, false)
+		}
+		t.text = text
+	}
+	return count
+}
+
+// textTokens returns the tokens of tree n in text order: the prefix,
+// token and suffix of each leaf.
+func textTokens(n *node) []*token {
+	var seq []*token
+	perNode(n, func(c *node) {
+		if c.children != nil {
+			return
+		}
+		for i := range c.token.prefix {
+			seq = append(seq, &c.token.prefix[i])
+		}
+		seq = append(seq, &c.token)
+		for i := range c.token.suffix {
+			seq = append(seq, &c.token.suffix[i])
+		}
+	})
+	return seq
+}
+
+// isBlank returns true iff t holds nothing but white space.  Tokens
+// emptied by replacements count as blank.
+func isBlank(t *token) bool {
+	return t.ttype == SPACE || (t.ttype != COMMENT && t.text == "")
+}
+
+// atLineStart returns true iff only white space precedes seq[k] on its
+// line.
+func atLineStart(seq []*token, k int) bool {
+	for j := k - 1; j >= 0; j-- {
+		if !isBlank(seq[j]) {
+			return false
+		}
+		if strings.Contains(seq[j].text, "\n") {
+			return true
+		}
+	}
+	return true
+}
+
+// atLineEnd returns true iff only white space follows seq[k] on its
+// line.
+func atLineEnd(seq []*token, k int) bool {
+	if strings.HasSuffix(seq[k].text, "\n") {
+		return true
+	}
+	for j := k + 1; j < len(seq); j++ {
+		if !isBlank(seq[j]) {
+			return false
+		}
+		if strings.Contains(seq[j].text, "\n") {
+			return true
+		}
+	}
+	return true
+}
+
+// trimBefore removes the white space between seq[k] and the start of
+// its line or the text before it on the same line.
+func trimBefore(seq []*token, k int) {
+	for j := k - 1; j >= 0 && isBlank(seq[j]); j-- {
+		if n := strings.LastIndex(seq[j].text, "\n"); n >= 0 {
+			seq[j].text = seq[j].text[:n+1]
+			return
+		}
+		seq[j].text = ""
+	}
+}
+
+// trimAfter removes the white space between seq[k] and the end of its
+// line or the text after it on the same line.  If newline is true, the
+// newline that ends the line is removed too.
+func trimAfter(seq []*token, k int, newline bool) {
+	for j := k + 1; j < len(seq) && isBlank(seq[j]); j++ {
+		if n := strings.Index(seq[j].text, "\n"); n >= 0 {
+			if newline {
+				n++
+			}
+			seq[j].text = seq[j].text[n:]
+			return
+		}
+		seq[j].text = ""
+	}
+}
+
+// indentAt returns the white space at the start of the line that
+// holds seq[k].
+func indentAt(seq []*token, k int) string {
+	line := ""
+	for j := k - 1; j >= 0; j-- {
+		text := seq[j].text
+		if n := strings.LastIndex(text, "\n"); n >= 0 {
+			line = text[n+1:] + line
+			break
+		}
+		line = text + line
+	}
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// deleteComment deletes the comment seq[k] along with the white space
+// next to it, so that no trailing white space is left behind.  If the
+// comment was alone on its line, the whole line is removed.
+func deleteComment(seq []*token, k int) {
+	t := seq[k]
+	newline := strings.HasSuffix(t.text, "\n")
+	first, last := atLineStart(seq, k), atLineEnd(seq, k)
+	t.ttype = SPACE
+	t.text = ""
+	switch {
+	case first && last:
+		trimBefore(seq, k)
+		if !newline {
+			trimAfter(seq, k, true)
+		}
+	case first:
+		trimAfter(seq, k, false)
+	default:
+		trimBefore(seq, k)
+		if newline {
+			t.text = "\n"
+		}
+	}
+}
+
+// checkCommentVars returns errors for the variables in replacement
+// comment t that are not in bound, the variables of the comment
+// pattern.
+func checkCommentVars(t token, bound map[string]bool) []string {
+	var errs []string
+	errorf := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	pieces, isVar := splitText(trimComment(t.text))
+	for i, piece := range pieces {
+		if !isVar[i] {
+			continue
+		}
+		if !strings.HasPrefix(piece, "${") {
+			if isAnonymous(piece) {
+				errorf("replacement %d:%d: anonymous variable %s cannot be used in the replacement", t.line, t.column, piece)
+			} else if _, _, ok := splitVarRef(piece, func(v string) bool { return bound[v] }); !ok {
+				errorf("replacement %d:%d: variable %s is not bound by the pattern", t.line, t.column, piece)
+			}
+			continue
+		}
+		e, err := parseExpr(piece)
+		if err == nil {
+			err = e.check()
+		}
+		if err != nil {
+			errorf("replacement %d:%d: %v", t.line, t.column, err)
+			continue
+		}
+		e.vars(func(name string) {
+			if !bound["$"+name] {
+				errorf("replacement %d:%d: variable $%s used in %s is not bound by the pattern", t.line, t.column, name, piece)
+			}
+		})
+	}
+	return errs
+}
+
+// matchComments returns true iff every comment pattern of r matches a
+// comment attached to the nodes in list.  Variables bound by the
+// comment patterns are added to m.
+func (r *rule) matchComments(list []*node, m match) bool {
+	for _, p := range r.comments {
+		found := false
+		for _, n := range list {
+			findComments(n, func(trivia []token, i int) {
+				if found {
+					return
+				}
+				if cm, ok := p.match(trivia[i]); ok {
+					for k, v := range cm.vars {
+						m.vars[k] = v
+					}
+					found = true
+				}
+			})
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
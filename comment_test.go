@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCommentPattern(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		comment string
+		vars    string // Sorted bindings, or "" if no match expected
+	}{
+		{"/* TODO($who) */", "/* TODO(bob) */", "$who=bob"},
+		{"/* TODO($who) */", "/*TODO(bob)*/", "$who=bob"},
+		{"/* TODO($who) */", "/* TODO (bob) */", ""},
+		{"/* TODO($who): $what */", "/*  TODO(a):\n   fix   it */", "$what=fix   it $who=a"},
+		{"// NOLINT($check)", "// NOLINT(old-check)\n", "$check=old-check"},
+		{"// NOLINT($check)", "/* NOLINT(old-check) */", ""},
+		{"/* $_ */", "/* anything */", "-"},
+		{"// cost $$5", "// cost $5\n", "-"},
+	} {
+		p := makeCommentPattern(c.pattern)
+		m, ok := p.match(token{ttype: COMMENT, text: c.comment})
+		if !ok {
+			if c.vars != "" {
+				t.Errorf("%q does not match %q", c.pattern, c.comment)
+			}
+			continue
+		}
+		var vars []string
+		for k, v := range m.vars {
+			vars = append(vars, fmt.Sprintf("%s=%s", k, innerText(v)))
+		}
+		sort.Strings(vars)
+		got := strings.Join(vars, " ")
+		if got == "" {
+			got = "-"
+		}
+		if got != c.vars {
+			t.Errorf("%q matching %q: got %q, expecting %q", c.pattern, c.comment, got, c.vars)
+		}
+	}
+}
+
+func TestReplaceComments(t *testing.T) {
+	for _, c := range []struct {
+		subject     string
+		pattern     string
+		replacement string
+		output      string
+	}{
+		{"/* TODO(bob) */ x;", "/* TODO($who) */", "// TODO(owner): $who", "// TODO(owner): bob\nx;"},
+		{"{\n    /* TODO(bob) */ x;\n}", "/* TODO($who) */", "// TODO(owner): $who", "{\n    // TODO(owner): bob\n    x;\n}"},
+		{"x; /* TODO(bob) */ \ny;", "/* TODO($who) */", "// TODO(owner): $who", "x; // TODO(owner): bob\ny;"},
+		{"x; // NOLINT(old-check)\ny;", "// NOLINT(old-check)", "", "x;\ny;"},
+		{"x; // NOLINT(old-check)", "// NOLINT(old-check)", "", "x;"},
+
+		// Deleting a comment also deletes the space next to it, and
+		// the line if nothing else is on it.
+		{"a;\n  // NOLINT(old-check)\n  b;", "// NOLINT(old-check)", "", "a;\n  b;"},
+		{"a;\n  /* gone */\n  b;", "/* gone */", "", "a;\n  b;"},
+		{"// NOLINT(old-check)\nb;", "// NOLINT(old-check)", "", "b;"},
+		{"a;\n  /* gone */ b;", "/* gone */", "", "a;\n  b;"},
+		{"x /* gone */ + y;", "/* gone */", "", "x + y;"},
+		{"x; /* gone */\ny;", "/* gone */", "", "x;\ny;"},
+		{"x; /* NOLINT(old-check) */ y;", "// NOLINT(old-check)", "", "x; /* NOLINT(old-check) */ y;"},
+		{"x; // TODO: fix\ny;", "// TODO: $what", "/* FIXME: ${upper(what)} */", "x; /* FIXME: FIX */\ny;"},
+	} {
+		r := &rule{pattern: parsePattern([]byte(c.pattern), ""), replacement: parsePattern([]byte(c.replacement), "")}
+		if errs, _ := r.validate(); len(errs) > 0 {
+			t.Errorf("validate(%q, %q): %q", c.pattern, c.replacement, errs)
+			continue
+		}
+		sub := parse([]byte(c.subject))
+		replace(sub, r)
+		if got := string(sub.serialize()); got != c.output {
+			t.Errorf("replace %q by %q in %q: got %q, expecting %q", c.pattern, c.replacement, c.subject, got, c.output)
+		}
+	}
+
+	for _, c := range []struct {
+		pattern     string
+		replacement string
+		err         string // Expected substring of the only error
+	}{
+		{"/* $x */", "f($x)", "must be a single comment or empty"},
+		{"/* TODO($who) */", "// TODO: $owner", "1:1: variable $owner is not bound"},
+		{"/* TODO($who) */", "// TODO: ${upper(owner)}", "variable $owner used in ${upper(owner)} is not bound"},
+		{"/* TODO($_) */", "// TODO: $_", "anonymous variable $_ cannot be used"},
+	} {
+		r := &rule{pattern: parsePattern([]byte(c.pattern), ""), replacement: parsePattern([]byte(c.replacement), "")}
+		if errs, _ := r.validate(); len(errs) != 1 || !strings.Contains(errs[0], c.err) {
+			t.Errorf("validate(%q, %q): got errors %q, expecting %q", c.pattern, c.replacement, errs, c.err)
+		}
+	}
+}
+
+func TestRequiredComments(t *testing.T) {
+	for _, c := range []struct {
+		subject   string
+		directive string
+		output    string
+	}{
+		{"a = 1;\n/* keep */ b = 2;", "comment: /* keep */", "a = 1;set(\n/* keep */ b , 2);"},
+		{"a = 1; /* keep */ b = 2;", "comment: /* keep */", "a = 1; /* keep */ b = 2;"},
+		{"/* owner: x */ a = 1; b = 2;", "comment: /* owner: $o */", "set(/* owner: x */ a , 2) /* x */; b = 2;"},
+	} {
+		r := &rule{pattern: parse([]byte("$a = $b")), replacement: parse([]byte("set($a, $b)"))}
+		if strings.Contains(c.directive, "$o") {
+			r.replacement = parse([]byte("set($a, 2) /* $o */"))
+		}
+		if err := r.addDirective(1, c.directive); err != nil {
+			t.Errorf("%s: %v", c.directive, err)
+			continue
+		}
+		sub := parse([]byte(c.subject))
+		replace(sub, r)
+		if got := string(sub.serialize()); got != c.output {
+			t.Errorf("%s in %q: got %q, expecting %q", c.directive, c.subject, got, c.output)
+		}
+	}
+}
+
+func TestCommentDirectiveVars(t *testing.T) {
+	// Variables bound by a comment: directive may be used anywhere in
+	// the replacement.
+	for _, c := range []struct {
+		replacement string
+		output      string
+	}{
+		{"set($a, $b); // $why", "set(/* TODO(later) */ x , y); // later"},
+		{"set($a, $b, $why);", "set(/* TODO(later) */ x , y, later);"},
+		{`set($a, $b, "${upper(why)}");`, `set(/* TODO(later) */ x , y, "LATER");`},
+	} {
+		rule := "$a = $b;\n---\n" + c.replacement + "\n---\ncomment: /* TODO($why) */\n"
+		r, err := parseRule([]byte(rule))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs, _ := r.validate(); len(errs) > 0 {
+			t.Errorf("validate(%q): %q", rule, errs)
+			continue
+		}
+		sub := parse([]byte("/* TODO(later) */ x = y;"))
+		replace(sub, r)
+		if got := string(sub.serialize()); got != c.output {
+			t.Errorf("replace(%q): got %q, expecting %q", rule, got, c.output)
+		}
+	}
+}
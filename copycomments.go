@@ -1,9 +1,14 @@
 package main
 
 // position identifies a particular token by combining line and column info,
-type position struct{ line, column int }
+// along with its text since tokens of the pattern and replacement may share
+// line and column numbers with tokens of the input.
+type position struct {
+	line, column int
+	text         string
+}
 
-func pos(t token) position { return position{t.line, t.column} }
+func pos(t token) position { return position{t.line, t.column, t.text} }
 
 // boundary contains info to be added as either prefix or suffix.
 type boundary struct {
@@ -14,14 +19,17 @@ type boundary struct {
 type copier struct {
 	seen           map[position]bool // Tokens already in destination.
 	prefix, suffix boundary          // Info to be added on either side
+	leaves         []*node           // Leaves of dst inserted by the replacement
+	claimed        map[*node]bool    // Leaves that already received comments
 }
 
 // copyComments copies all comments in src to dst that are not already
-// present in dst.  It also adds leading and trailing whitespace if necessary.
+// present in dst.  A comment found in the middle of src on a token T is
+// attached to the first unclaimed occurrence of T that the replacement
+// (rather than a variable) put in dst.  Other comments go before or
+// after dst.  It also adds leading and trailing whitespace if necessary.
 func copyComments(src []*node, dst []*node) []*node {
-	// Could enhance this by attaching comments found on a token T in src
-	// to the first untouched occurrence of T in dst.
-	c := &copier{seen: make(map[position]bool)}
+	c := &copier{seen: make(map[position]bool), claimed: make(map[*node]bool)}
 
 	// Find all comments that have already been copied, perhaps
 	// because a variable assignment copied some portion of src.
@@ -36,6 +44,15 @@ func copyComments(src []*node, dst []*node) []*node {
 		})
 	}
 
+	// Leaves copied from src by variables already have their comments.
+	for _, n := range dst {
+		for _, l := range leaves(n) {
+			if l.replaced {
+				c.leaves = append(c.leaves, l)
+			}
+		}
+	}
+
 	// Now walk through src, copying all uncopied comments.
 	for i, n := range src {
 		c.copyNodeComments(n, i == 0, i == len(src)-1)
@@ -60,6 +77,9 @@ func copyComments(src []*node, dst []*node) []*node {
 
 func (c *copier) copyNodeComments(n *node, leftSide, rightSide bool) {
 	num := len(n.children)
+	if num == 0 && c.attach(n, leftSide, rightSide) {
+		return
+	}
 	c.copyCommentTokens(n.token.prefix, leftSide, false)
 	for i, child := range n.children {
 		c.copyNodeComments(child, leftSide && (i == 0), rightSide && (i == num-1))
@@ -67,6 +87,66 @@ func (c *copier) copyNodeComments(n *node, leftSide, rightSide bool) {
 	c.copyCommentTokens(n.token.suffix, false, rightSide)
 }
 
+// attach copies the uncopied comments of leaf n, except those on the
+// outer side of src, to the first unclaimed leaf of dst with the same
+// text.  It returns false if there is no such leaf.
+func (c *copier) attach(n *node, leftSide, rightSide bool) bool {
+	var prefix, suffix []token
+	if !leftSide {
+		prefix = c.uncopied(n.token.prefix, false)
+	}
+	if !rightSide {
+		suffix = c.uncopied(n.token.suffix, true)
+	}
+	if len(prefix)+len(suffix) == 0 {
+		return false
+	}
+	var target *node
+	for _, l := range c.leaves {
+		if !c.claimed[l] && l.token.ttype == n.token.ttype && l.token.text == n.token.text {
+			target = l
+			break
+		}
+	}
+	if target == nil {
+		return false
+	}
+	c.claimed[target] = true
+	for _, t := range append(prefix, suffix...) {
+		c.seen[pos(t)] = true
+	}
+	if leftSide {
+		c.copyCommentTokens(n.token.prefix, true, false)
+	}
+	if rightSide {
+		c.copyCommentTokens(n.token.suffix, false, true)
+	}
+	t := &target.token
+	t.prefix = append(append([]token(nil), t.prefix...), prefix...)
+	t.suffix = append(suffix, t.suffix...)
+	return true
+}
+
+// uncopied returns the comments in list that are not yet in dst, along
+// with the space that separates each one from the token: the space
+// before a comment in a suffix, or after a comment in a prefix.
+func (c *copier) uncopied(list []token, suffix bool) []token {
+	var result []token
+	for i, t := range list {
+		if t.ttype != COMMENT || c.seen[pos(t)] {
+			continue
+		}
+		if suffix && i > 0 && list[i-1].ttype == SPACE {
+			result = append(result, list[i-1])
+		}
+		result = append(result, t)
+		if !suffix && i+1 < len(list) && list[i+1].ttype == SPACE {
+			result = append(result, list[i+1])
+		}
+	}
+	return result
+}
+
 func (c *copier) copyCommentTokens(list []token, leftSide, rightSide bool) {
 	for _, t := range list {
 		if c.seen[pos(t)] {
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// dumpTree writes an indented description of the tree rooted at n to w.
+// Each leaf is printed on its own line in the bracketed form of
+// String(), along with its token type, position, and any prefix/suffix
+// trivia attached to it.  Unlike String(), the output is meant for
+// people trying to understand how parse() structured some text.
+func dumpTree(w io.Writer, n *node) {
+	var write func(n *node, indent string)
+	write = func(n *node, indent string) {
+		if n.children == nil {
+			fmt.Fprintf(w, "%s%s\n", indent, describeLeaf(n))
+			for _, t := range n.token.prefix {
+				fmt.Fprintf(w, "%s    prefix %s\n", indent, describeToken(t))
+			}
+			for _, t := range n.token.suffix {
+				fmt.Fprintf(w, "%s    suffix %s\n", indent, describeToken(t))
+			}
+			return
+		}
+		fmt.Fprintf(w, "%s(\n", indent)
+		for _, c := range n.children {
+			write(c, indent+"  ")
+		}
+		fmt.Fprintf(w, "%s)\n", indent)
+	}
+	write(n, "")
+}
+
+// dumpDot writes the tree rooted at n to w as a Graphviz digraph
+// with the specified name.
+func dumpDot(w io.Writer, name string, n *node) {
+	fmt.Fprintf(w, "digraph %s {\n", dotQuote(name))
+	fmt.Fprintf(w, "  node [shape=box, fontname=monospace];\n")
+	id := 0
+	var write func(n *node) int
+	write = func(n *node) int {
+		me := id
+		id++
+		if n.children == nil {
+			label := describeLeaf(n)
+			for _, t := range n.token.prefix {
+				label += "\nprefix " + describeToken(t)
+			}
+			for _, t := range n.token.suffix {
+				label += "\nsuffix " + describeToken(t)
+			}
+			fmt.Fprintf(w, "  n%d [label=%s];\n", me, dotQuote(label))
+			return me
+		}
+		fmt.Fprintf(w, "  n%d [label=\"\", shape=point];\n", me)
+		for _, c := range n.children {
+			fmt.Fprintf(w, "  n%d -> n%d;\n", me, write(c))
+		}
+		return me
+	}
+	write(n)
+	fmt.Fprintf(w, "}\n")
+}
+
+// describeLeaf returns a single line description of leaf n that shows
+// its token type, line:column and text as printed by String().
+func describeLeaf(n *node) string {
+	t := n.token
+	return fmt.Sprintf("%s %d:%d %s", t.ttype, t.line, t.column, n)
+}
+
+// describeToken returns a single line description of t that shows
+// its type, line:column and quoted text.  It is used for trivia, whose
+// text may span lines.
+func describeToken(t token) string {
+	return fmt.Sprintf("%s %d:%d %q", t.ttype, t.line, t.column, t.text)
+}
+
+// dotQuote returns s as a quoted Graphviz string.  Newlines in s
+// become left-justified line breaks.
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\l`, -1)
+	if strings.Contains(s, `\l`) {
+		s += `\l`
+	}
+	return `"` + s + `"`
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDumpTree(t *testing.T) {
+	var buf bytes.Buffer
+	dumpTree(&buf, parse([]byte("f(x) /*c*/")))
+	expect := `(
+  WORD 1:1 [f]
+  OPENER 1:2 [(]
+  WORD 1:3 [x]
+  CLOSER 1:4 [)]
+      suffix SPACE 1:5 " "
+      suffix COMMENT 1:6 "/*c*/"
+)
+`
+	if got := buf.String(); got != expect {
+		t.Errorf("dumpTree:\nGot:\n%s\nExpect:\n%s\n", got, expect)
+	}
+}
+
+func TestDumpDot(t *testing.T) {
+	var buf bytes.Buffer
+	dumpDot(&buf, `my "tree"`, parse([]byte(`f("\"") /*c*/`)))
+	expect := `digraph "my \"tree\"" {
+  node [shape=box, fontname=monospace];
+  n0 [label="", shape=point];
+  n1 [label="WORD 1:1 [f]"];
+  n0 -> n1;
+  n2 [label="OPENER 1:2 [(]"];
+  n0 -> n2;
+  n3 [label="STRING 1:3 [\"\\\"\"]"];
+  n0 -> n3;
+  n4 [label="CLOSER 1:7 [)]\lsuffix SPACE 1:8 \" \"\lsuffix COMMENT 1:9 \"/*c*/\"\l"];
+  n0 -> n4;
+}
+`
+	if got := buf.String(); got != expect {
+		t.Errorf("dumpDot:\nGot:\n%s\nExpect:\n%s\n", got, expect)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// explainer produces a step by step account of how a pattern is
+// compared against the subject nodes found at some position.  The
+// comparison mirrors what pattern.match does, but walks the pattern
+// one element at a time so that it can say which element failed
+// instead of just reporting that the synthesized regexp did not match.
+type explainer struct {
+	w      io.Writer
+	indent string
+}
+
+// explain reports to w how the pattern of r compares against subject
+// at the token found at line:column.  Every enclosing level of the
+// subject tree is tried, starting with the innermost one, until the
+// pattern matches and the match satisfies the other settings of r
+// (operand order, operator chains, conditions, context and comments).
+// The result is true iff the rule matched at some level.
+func explain(w io.Writer, subject *node, r *rule, line, column int) bool {
+	e := &explainer{w: w}
+	pattern := r.pattern
+	if len(r.associative) > 0 {
+		// Compare flat chains as replace does.
+		pattern = clone(pattern)
+		flattenChains(pattern, r.associative)
+		fixFields(pattern, nil, 0)
+		flattenChains(subject, r.associative)
+		fixFields(subject, nil, 0)
+	}
+	r.reach = nil
+	leaf := findLeaf(subject, line, column)
+	if leaf == nil {
+		e.printf("no token found at %d:%d", line, column)
+		return false
+	}
+	e.printf("token at %d:%d is %s", line, column, describe(leaf))
+
+	pat := makePattern(pattern)
+	if len(r.commutative) > 0 {
+		pat.allowSwap(r.commutative)
+	}
+	level := 0
+	for n := leaf; n.parent != nil; n = n.parent {
+		level++
+		list := n.parent.children
+		index := 0
+		for list[index] != n {
+			index++
+		}
+		e.printf("level %d: list of %d nodes starting at %s", level, len(list)-index, describe(n))
+		e.indent = "  "
+		compared := e.compareList(pattern.children, list[index:], false)
+		m, ok := pat.match(list[index:])
+		if ok && m.start == 0 && !compared {
+			e.printf("pattern matches with the operands of a commutative operator swapped")
+		}
+		accepted := ok && m.start == 0 && e.checkRule(r, n.parent, index, m)
+		e.indent = ""
+		if accepted {
+			e.printf("result: pattern matches %d nodes at level %d", m.limit, level)
+			return true
+		}
+		if ok && m.start > 0 {
+			e.printf("pattern matches later in this list, at %s", describe(list[index+m.start]))
+		}
+	}
+	e.printf("result: pattern does not match at %d:%d", line, column)
+	return false
+}
+
+// checkRule reports whether match m of the nodes starting at
+// list.children[index] satisfies the required comments, where
+// conditions and context restrictions of r.
+func (e *explainer) checkRule(r *rule, list *node, index int, m match) bool {
+	nodes := list.children[index : index+m.limit]
+	if !r.matchComments(nodes, m) {
+		e.printf("FAIL: the matched code lacks a required comment")
+		return false
+	}
+	for _, c := range r.where {
+		if c.holds(m) == c.negate {
+			e.printf("FAIL: where condition on line %d rejects the match", c.line)
+			return false
+		}
+	}
+	for _, p := range r.inside {
+		if !r.encloses(p, list, index, index+m.limit) {
+			e.printf("FAIL: match is not inside %s", describeList(p.list))
+			return false
+		}
+	}
+	for _, p := range r.notInside {
+		if r.encloses(p, list, index, index+m.limit) {
+			e.printf("FAIL: match is inside %s", describeList(p.list))
+			return false
+		}
+	}
+	return true
+}
+
+// compareList compares a list of pattern nodes against a list of
+// subject nodes, reporting each step.  If full is true, the pattern
+// must account for every subject node.  The result is false at the
+// first mismatch.
+func (e *explainer) compareList(plist, slist []*node, full bool) bool {
+	plist, clauses := splitContains(plist)
+	if full && !hasRepeat(plist) && len(plist) != len(slist) {
+		e.printf("FAIL: child-list length differs: pattern has %d nodes, subject has %d", len(plist), len(slist))
+		return false
+	}
+	j := 0
+	for i, p := range plist {
+		if p.children == nil && p.token.ttype == RVAR {
+			n := e.repeatLength(p, plist[i+1:], slist[j:], full)
+			if min, max, _ := repeatBounds(p.token.text); n < min || (max >= 0 && n > max) {
+				e.printf("FAIL: repeat count mismatch: %s binds %s nodes, subject has %d: %s", p.token.text, describeBounds(min, max), n, describeList(slist[j:j+n]))
+				return false
+			}
+			e.printf("%s binds %d nodes: %s", p.token.text, n, describeList(slist[j:j+n]))
+			if !e.checkClause(clauses[i], slist[j:j+n]) {
+				return false
+			}
+			j += n
+			continue
+		}
+		if j >= len(slist) {
+			e.printf("FAIL: child-list length differs: subject list ends before pattern %s", describe(p))
+			return false
+		}
+		s := slist[j]
+		j++
+		switch {
+		case p.children == nil && p.token.ttype == VAR:
+			e.printf("%s binds %s", p.token.text, describe(s))
+			if !e.checkClause(clauses[i], []*node{s}) {
+				return false
+			}
+		case p.children == nil && p.token.ttype == WVAR:
+			if !makeWordPattern(p.token.text).match(s, make(map[string][]*node)) {
+				e.printf("FAIL: word mismatch: pattern %s, subject %s", describe(p), describe(s))
+				return false
+			}
+			e.printf("word %s matches %s", p.token.text, describe(s))
+		case p.children == nil && hasStringVars(p.token):
+			if !makeStringPattern(p.token.text).match(s, make(map[string][]*node)) {
+				e.printf("FAIL: string mismatch: pattern %s, subject %s", describe(p), describe(s))
+				return false
+			}
+			e.printf("string %s matches %s", p.token.text, describe(s))
+		case p.children == nil && p.token.ttype == ALT:
+			_, alts := splitAlt(p.token.text)
+			found := false
+			for _, a := range alts {
+				found = found || (s.children == nil && s.token.text == a)
+			}
+			if !found {
+				e.printf("FAIL: none of the alternatives in %s matches subject %s", p.token.text, describe(s))
+				return false
+			}
+			e.printf("alternative in %s matches %s", p.token.text, describe(s))
+		case p.children == nil && s.children == nil:
+			if p.token.text != s.token.text {
+				e.printf("FAIL: literal token mismatch: pattern %s, subject %s", describe(p), describe(s))
+				return false
+			}
+			e.printf("literal %s matches", describe(s))
+		case p.children == nil:
+			e.printf("FAIL: parse() grouped subject differently: pattern token %s, subject subtree %s", describe(p), describe(s))
+			return false
+		case s.children == nil:
+			e.printf("FAIL: parse() grouped pattern differently: pattern subtree %s, subject token %s", describe(p), describe(s))
+			return false
+		default:
+			e.printf("descend into subtree %s", describe(s))
+			saved := e.indent
+			e.indent += "  "
+			ok := e.compareList(p.children, s.children, true)
+			e.indent = saved
+			if !ok {
+				return false
+			}
+		}
+	}
+	if full && j < len(slist) {
+		e.printf("FAIL: child-list length differs: subject has %d extra nodes: %s", len(slist)-j, describeList(slist[j:]))
+		return false
+	}
+	return true
+}
+
+// checkClause reports whether the nodes bound to a variable contain a
+// match for the contains clause inner (if any).
+func (e *explainer) checkClause(inner []*node, bound []*node) bool {
+	if inner == nil {
+		return true
+	}
+	text := describeList(inner)
+	if _, ok := makeListPattern(inner, false, make(map[string]rune)).search(bound); !ok {
+		e.printf("FAIL: %s does not contain %s", describeList(bound), text)
+		return false
+	}
+	e.printf("%s contains %s", describeList(bound), text)
+	return true
+}
+
+// repeatLength guesses how many subject nodes the repeated variable v
+// consumes given the pattern nodes rest that follow it.  If the rest of
+// a full match has no repeats, the variable takes whatever the rest
+// does not need.  Otherwise if the next pattern node is a literal
+// token, the variable extends up to the next occurrence of that token
+// that leaves it at least its minimum count, or else up to the first
+// one.  Without such hints, it takes its minimum count.  The caller
+// checks the result against the bounds of v.
+func (e *explainer) repeatLength(v *node, rest, slist []*node, full bool) int {
+	min, max, _ := repeatBounds(v.token.text)
+	if len(rest) == 0 {
+		if !full && max >= 0 && max < len(slist) {
+			// The match may end before the list does.
+			return max
+		}
+		return len(slist)
+	}
+	if full && !hasRepeat(rest) {
+		if len(slist) < len(rest) {
+			return 0
+		}
+		return len(slist) - len(rest)
+	}
+	next := rest[0]
+	if next.children == nil && isLiteral(next.token) {
+		first := -1
+		for j, s := range slist {
+			if s.children == nil && s.token.text == next.token.text {
+				if j >= min {
+					return j
+				}
+				if first < 0 {
+					first = j
+				}
+			}
+		}
+		if first >= 0 {
+			return first
+		}
+		return len(slist)
+	}
+	if min > len(slist) {
+		return len(slist)
+	}
+	return min
+}
+
+// describeBounds describes the number of nodes that a repeated
+// variable with the given bounds binds.
+func describeBounds(min, max int) string {
+	switch {
+	case max < 0:
+		return fmt.Sprintf("at least %d", min)
+	case min == max:
+		return fmt.Sprintf("exactly %d", min)
+	default:
+		return fmt.Sprintf("%d to %d", min, max)
+	}
+}
+
+func (e *explainer) printf(format string, args ...interface{}) {
+	fmt.Fprintf(e.w, "%s%s\n", e.indent, fmt.Sprintf(format, args...))
+}
+
+// findLeaf returns the leaf in tree n whose token covers line:column,
+// or nil if there is no such leaf.
+func findLeaf(n *node, line, column int) *node {
+	var result *node
+	perNode(n, func(c *node) {
+		if result != nil || c.children != nil || c.token.ttype == END {
+			return
+		}
+		t := c.token
+		if t.line == line && column >= t.column && column < t.column+len(t.text) {
+			result = c
+		}
+	})
+	return result
+}
+
+// hasRepeat returns true iff list contains a repeated variable.
+func hasRepeat(list []*node) bool {
+	for _, n := range list {
+		if n.children == nil && n.token.ttype == RVAR {
+			return true
+		}
+	}
+	return false
+}
+
+// describe returns a short single line description of n for use in
+// explanations.
+func describe(n *node) string {
+	first := n
+	for len(first.children) > 0 {
+		first = first.children[0]
+	}
+	return fmt.Sprintf("%q at %d:%d", shortText([]*node{n}), first.token.line, first.token.column)
+}
+
+func describeList(list []*node) string {
+	return fmt.Sprintf("%q", shortText(list))
+}
+
+// shortText returns the text of list without surrounding trivia,
+// collapsing internal white space and eliding long text.
+func shortText(list []*node) string {
+	text := string((&node{children: list}).serialize())
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > 40 {
+		text = text[:37] + "..."
+	}
+	return text
+}
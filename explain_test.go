@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	type test struct {
+		subject string
+		pattern string
+		line    int
+		column  int
+		matched bool
+		failure string // Expected first failure message (if any)
+	}
+	for _, c := range []test{
+		{"f(a, b)", "f($x, $y)", 1, 1, true, ""},
+		{"f(a, b)", "f($x; $y)", 1, 1, false, "literal token mismatch"},
+		{"f(a, b)", "f($x)", 1, 1, false, "literal token mismatch"},
+		{"f(g(a), b)", "f(g($x, $y), b)", 1, 1, false, "pattern has 6 nodes, subject has 4"},
+		{"f(g(a, b, c))", "f(g($x*, b, c))", 1, 1, true, ""},
+		{"f(g(a, b, c))", "f(g($x*, c, d))", 1, 1, false, "literal token mismatch"},
+		{"a b", "a b c", 1, 1, false, "subject list ends before"},
+		{"get_x(1)", "get_$f(1)", 1, 1, true, ""},
+		{"set_x(1)", "get_$f(1)", 1, 1, false, "word mismatch"},
+		{`f("%d")`, `f("$a%lu")`, 1, 1, false, "string mismatch"},
+		{"free(p->x)", "free($p contains $_->$_)", 1, 1, true, ""},
+		{"free(p.x)", "free($p contains $_->$_)", 1, 1, false, `"p.x" does not contain "$_->$_"`},
+		{"f(a+b)", "f(a)", 1, 3, false, "grouped subject differently"},
+		{"x = f(a)", "f($x)", 1, 5, true, ""},
+		{"f(a)", "f($x)", 3, 1, false, "no token found"},
+		{"foo(x, y + 1)", "foo($a, $b{2} + 1)", 1, 1, false, "repeat count mismatch: $b{2} binds exactly 2 nodes, subject has 1"},
+		{"f(a b)", "f($x{2})", 1, 1, true, ""},
+		{"f()", "f($x+)", 1, 1, false, "$x+ binds at least 1 nodes, subject has 0"},
+		{"f(a b c)", "f($x{1,2})", 1, 1, false, "$x{1,2} binds 1 to 2 nodes, subject has 3"},
+		{"f(a)", "f($x?)", 1, 1, true, ""},
+	} {
+		var buf bytes.Buffer
+		r := &rule{pattern: parsePattern([]byte(c.pattern), "")}
+		matched := explain(&buf, parse([]byte(c.subject)), r, c.line, c.column)
+		out := buf.String()
+		if matched != c.matched {
+			t.Errorf("Explain(%s, %s): matched %v, expect %v\n%s", c.subject, c.pattern, matched, c.matched, out)
+		}
+		if c.failure != "" && !strings.Contains(out, c.failure) {
+			t.Errorf("Explain(%s, %s): output does not mention %q:\n%s", c.subject, c.pattern, c.failure, out)
+		}
+	}
+}
+
+func TestExplainRule(t *testing.T) {
+	for _, c := range []struct {
+		subject    string
+		pattern    string
+		directives []string
+		column     int
+		matched    bool
+		message    string // Expected text in the output
+	}{
+		{"if (NULL == p) f();", "$x == NULL", []string{"commutative =="}, 5, true, "operands of a commutative operator swapped"},
+		{"if (NULL == p) f();", "$x == NULL", nil, 5, false, "does not match"},
+		{"a + b + c;", "b + c", []string{"associative +"}, 5, true, "matches 3 nodes"},
+		{"f(1);", "f($x)", []string{"where $x =~ /^[a-z]/"}, 1, false, "where condition on line 1 rejects"},
+		{"g() { f(1); }", "f($x)", []string{"not-inside: g() {$_*}"}, 7, false, `match is inside "g() {$_*?}"`},
+		{"g() { f(1); }", "f($x)", []string{"inside: h() {$_*}"}, 7, false, `match is not inside "h() {$_*?}"`},
+		{"f(1);", "f($x)", []string{"comment: /* keep */"}, 1, false, "lacks a required comment"},
+	} {
+		r := &rule{pattern: parsePattern([]byte(c.pattern), "")}
+		for _, d := range c.directives {
+			if err := r.addDirective(1, d); err != nil {
+				t.Fatalf("%s: %v", d, err)
+			}
+		}
+		var buf bytes.Buffer
+		matched := explain(&buf, parse([]byte(c.subject)), r, 1, c.column)
+		out := buf.String()
+		if matched != c.matched || !strings.Contains(out, c.message) {
+			t.Errorf("Explain(%s, %s, %q): matched %v, expecting %v and %q:\n%s", c.subject, c.pattern, c.directives, matched, c.matched, c.message, out)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// fileEdit is a line-level edit that a rule makes to every file in which
+// it replaces something, e.g., to add the #include needed by the
+// replacement.
+type fileEdit struct {
+	remove bool     // If true, remove the line instead of ensuring it exists
+	line   string   // Text of the line with runs of spaces collapsed
+	unless []string // Words whose use in the file prevents removal
+}
+
+// parseFileEdit parses the text after an ensure-line or remove-line
+// directive.  A removed line may be followed by "unless-used" and a list
+// of words, e.g., "#include <strings.h> unless-used bcopy bzero".
+func parseFileEdit(remove bool, text string) (*fileEdit, error) {
+	e := &fileEdit{remove: remove}
+	fields := strings.Fields(text)
+	if remove {
+		for i, f := range fields {
+			if f == "unless-used" {
+				e.unless = fields[i+1:]
+				if len(e.unless) == 0 {
+					return nil, errors.New("missing words after unless-used")
+				}
+				fields = fields[:i]
+				break
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("missing line text")
+	}
+	e.line = strings.Join(fields, " ")
+	return e, nil
+}
+
+// editFile applies edits to data, the serialized form of root, and
+// returns the result along with ranges adjusted for the lines that were
+// added and removed.
+//
+// A line that must exist is added after the last line that starts with
+// the same word (e.g., "#include"), or at the start of the file if there
+// is none.  Lines are compared with runs of spaces collapsed.
+func editFile(root *node, data []byte, edits []*fileEdit, ranges []lineRange) ([]byte, []lineRange) {
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	words := make(map[string]bool)
+	perNode(root, func(n *node) {
+		if n.children == nil && n.token.ttype == WORD {
+			words[n.token.text] = true
+		}
+	})
+	same := func(line, text string) bool {
+		return strings.Join(strings.Fields(line), " ") == text
+	}
+
+	for _, e := range edits {
+		if e.remove {
+			used := false
+			for _, w := range e.unless {
+				used = used || words[w]
+			}
+			if used {
+				continue
+			}
+			for i := 0; i < len(lines); i++ {
+				if same(lines[i], e.line) {
+					lines = append(lines[:i], lines[i+1:]...)
+					ranges = shiftRanges(ranges, i+1, -1)
+					i--
+				}
+			}
+			continue
+		}
+
+		at, found := 0, false
+		first := strings.Fields(e.line)[0]
+		for i, line := range lines {
+			if same(line, e.line) {
+				found = true
+				break
+			}
+			if f := strings.Fields(line); len(f) > 0 && f[0] == first {
+				at = i + 1
+			}
+		}
+		if found {
+			continue
+		}
+		if at > 0 && !strings.HasSuffix(lines[at-1], "\n") {
+			lines[at-1] += "\n"
+		}
+		lines = append(lines[:at], append([]string{e.line + "\n"}, lines[at:]...)...)
+		ranges = shiftRanges(ranges, at+1, 1)
+	}
+	return []byte(strings.Join(lines, "")), ranges
+}
+
+// shiftRanges adjusts ranges for delta lines (1 or -1) inserted or
+// removed at line.
+func shiftRanges(ranges []lineRange, line, delta int) []lineRange {
+	var result []lineRange
+	for _, r := range ranges {
+		switch {
+		case r.first > line || (delta > 0 && r.first == line):
+			r.first += delta
+			r.last += delta
+		case r.last >= line:
+			r.last += delta
+		}
+		if r.first <= r.last {
+			result = append(result, r)
+		}
+	}
+	return result
+}
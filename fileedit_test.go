@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEditFile(t *testing.T) {
+	for _, c := range []struct {
+		input  string
+		edits  []string
+		output string
+		ranges string
+	}{
+		// Lines are added after the last line with the same first word.
+		{"#include <a.h>\n#include <c.h>\n\nx;\n", []string{"ensure-line #include <b.h>"},
+			"#include <a.h>\n#include <c.h>\n#include <b.h>\n\nx;\n", "[{2 2}]"},
+		{"x;\n", []string{"ensure-line #include <b.h>"}, "#include <b.h>\nx;\n", "[{3 3}]"},
+		{"#include <b.h>", []string{"ensure-line #include <c.h>"}, "#include <b.h>\n#include <c.h>\n", "[{3 3}]"},
+		{"#include  <b.h>\nx;\n", []string{"ensure-line #include <b.h>"}, "#include  <b.h>\nx;\n", "[{2 2}]"},
+
+		// Lines are removed unless one of the words is used.
+		{"#include <b.h>\nx;\n", []string{"remove-line #include <b.h>"}, "x;\n", "[{1 1}]"},
+		{"#include <b.h>\nx;\n", []string{"remove-line #include <b.h> unless-used y x"}, "#include <b.h>\nx;\n", "[{2 2}]"},
+		{"#include <b.h>\nx;\n", []string{"remove-line #include <b.h> unless-used y"}, "x;\n", "[{1 1}]"},
+
+		// Both at once.
+		{"#include <a.h>\n#include <b.h>\nx;\n",
+			[]string{"ensure-line #include <c.h>", "remove-line #include <a.h>"},
+			"#include <b.h>\n#include <c.h>\nx;\n", "[{1 1}]"},
+	} {
+		var edits []*fileEdit
+		for _, text := range c.edits {
+			keyword, rest := splitFirst(text)
+			e, err := parseFileEdit(keyword == "remove-line", rest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			edits = append(edits, e)
+		}
+		root := parse([]byte(c.input))
+		out, ranges := editFile(root, []byte(c.input), edits, []lineRange{{2, 2}})
+		if string(out) != c.output || fmt.Sprint(ranges) != c.ranges {
+			t.Errorf("editFile(%q, %q): got %q %v, expecting %q %s",
+				c.input, c.edits, out, ranges, c.output, c.ranges)
+		}
+	}
+}
+
+func TestShiftRanges(t *testing.T) {
+	for _, c := range []struct {
+		line, delta int
+		want        string
+	}{
+		{1, 1, "[{3 4} {7 7}]"},
+		{2, 1, "[{3 4} {7 7}]"},
+		{3, 1, "[{2 4} {7 7}]"},
+		{4, 1, "[{2 3} {7 7}]"},
+		{2, -1, "[{2 2} {5 5}]"},
+		{1, -1, "[{1 2} {5 5}]"},
+		{6, -1, "[{2 3}]"},
+	} {
+		got := fmt.Sprint(shiftRanges([]lineRange{{2, 3}, {6, 6}}, c.line, c.delta))
+		if got != c.want {
+			t.Errorf("shiftRanges(%d, %d): got %s, expecting %s", c.line, c.delta, got, c.want)
+		}
+	}
+}
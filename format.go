@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// lineRange is an inclusive range of line numbers, starting at 1.
+type lineRange struct{ first, last int }
+
+// changedLines returns the lines of the serialized form of root that
+// hold text inserted by replacements, as a sorted list of disjoint
+// ranges.
+func changedLines(root *node) []lineRange {
+	var ranges []lineRange
+	line := 1
+	count := func(text string) { line += strings.Count(text, "\n") }
+
+	// walk serializes n, counting lines, and returns the lines on which
+	// the text of its first and last tokens (including comments before
+	// the first) start and end.
+	var walk func(n *node) (int, int)
+	walk = func(n *node) (int, int) {
+		first, last := 0, 0
+		if n.children == nil {
+			// Comments before the token belong to it.
+			for _, t := range n.token.prefix {
+				if t.ttype == COMMENT && first == 0 {
+					first = line
+				}
+				count(t.text)
+			}
+			if first == 0 {
+				first = line
+			}
+			count(n.token.text)
+			last = line
+			for _, t := range n.token.suffix {
+				count(t.text)
+			}
+			if n.token.text == "" {
+				// Empty tokens (e.g., left by deletions) insert no text.
+				first, last = 0, 0
+			}
+		}
+		for _, c := range n.children {
+			f, l := walk(c)
+			if f == 0 {
+				continue
+			}
+			if first == 0 {
+				first = f
+			}
+			last = l
+		}
+		if n.replaced && first > 0 {
+			ranges = append(ranges, lineRange{first, last})
+		}
+		return first, last
+	}
+	walk(root)
+
+	// Sort by first line (ranges of nested nodes come first) and merge.
+	for i := 1; i < len(ranges); i++ {
+		for j := i; j > 0 && ranges[j].first < ranges[j-1].first; j-- {
+			ranges[j], ranges[j-1] = ranges[j-1], ranges[j]
+		}
+	}
+	var merged []lineRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.first <= merged[n-1].last+1 {
+			if r.last > merged[n-1].last {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// format pipes data through the formatter command cmd, passing one
+// argument per range of lines, produced by formatting the first and
+// last line of the range with linesFormat (e.g., "--lines=%d:%d").
+// cmd is split into words at spaces; it is not run by a shell.
+func format(cmd, linesFormat string, data []byte, ranges []lineRange) ([]byte, error) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty formatter command")
+	}
+	for _, r := range ranges {
+		args = append(args, fmt.Sprintf(linesFormat, r.first, r.last))
+	}
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("%s: %v", strings.Join(args, " "), err)
+	}
+	return stdout.Bytes(), nil
+}
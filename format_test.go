@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestChangedLines(t *testing.T) {
+	for _, c := range []struct {
+		subject     string
+		pattern     string
+		replacement string
+		want        string
+	}{
+		{"a;\nb;\n", "x", "y", "[]"},
+		{"a;\nf(x);\nc;\n", "f($a)", "g($a)", "[{2 2}]"},
+		{"f(x);\nb;\nf(y);\n", "f($a)", "g($a)", "[{1 1} {3 3}]"},
+		{"f(x);\nf(y);\n", "f($a)", "g($a)", "[{1 2}]"},
+		{"a;\nf(x);\n", "f($a)", "g($a,\n  1)", "[{2 3}]"},
+		{"a;\nf(x);\nb;\n", "f($a);\n", "", "[]"},
+		{"a;\n// c\nf(x);\nb;\n", "f($a);", "", "[]"},
+		{"a;\nf(x);\n", "f($a)", "/* long\ncomment */ g($a)", "[{2 3}]"},
+	} {
+		subject := parse([]byte(c.subject))
+		replace(subject, &rule{pattern: parsePattern([]byte(c.pattern), ""), replacement: parsePattern([]byte(c.replacement), "")})
+		if got := fmt.Sprint(changedLines(subject)); got != c.want {
+			t.Errorf("changedLines(%q, %q => %q): got %s, expecting %s\n%s",
+				c.subject, c.pattern, c.replacement, got, c.want, subject.serialize())
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	if _, err := exec.LookPath("/bin/sh"); err != nil {
+		t.Skip("no shell")
+	}
+	// The formatter prints its arguments followed by its input.
+	script := `/bin/sh -c echo$IFS"$*";cat fmt`
+	got, err := format(script, "-l%d-%d", []byte("x\n"), []lineRange{{1, 2}, {5, 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-l1-2 -l5-5\nx\n"; string(got) != want {
+		t.Errorf("format: got %q, expecting %q", got, want)
+	}
+
+	_, err = format("/bin/sh -c exit$IFS\"3\"", "%d:%d", nil, []lineRange{{1, 1}})
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("format: got error %v, expecting exit status 3", err)
+	}
+}
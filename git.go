@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// runGit runs git with args in directory dir and returns its output.
+func runGit(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("git %s: %v", strings.Join(args, " "), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// changedSince returns the lines of fname that were added or changed
+// since git revision base, including changes that are not committed.
+// It returns nil (every line) if git does not track fname.
+func changedSince(base, fname string) ([]lineRange, error) {
+	dir, name := filepath.Dir(fname), filepath.Base(fname)
+	out, err := runGit(dir, "diff", "--no-ext-diff", "-U0", base, "--", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		tracked, err := runGit(dir, "ls-files", "--", name)
+		if err != nil {
+			return nil, err
+		}
+		if len(tracked) == 0 {
+			return nil, nil
+		}
+	}
+	return diffLines(out), nil
+}
+
+// gitFiles returns the files under the current directory selected by
+// the -git-changed (changes since revision changed), -git-staged and
+// -git-tracked flags, limited to those that match pathspecs if any.
+// Deleted files, including tracked files deleted from the working
+// tree, are omitted.  At most one of the flags may be set.
+func gitFiles(changed string, staged, tracked bool, pathspecs []string) ([]string, error) {
+	var args []string
+	n := 0
+	if changed != "" {
+		args = []string{"diff", "--no-ext-diff", "--name-only", "--relative", "-z", "--diff-filter=d", changed}
+		n++
+	}
+	if staged {
+		args = []string{"diff", "--no-ext-diff", "--name-only", "--relative", "-z", "--diff-filter=d", "--cached"}
+		n++
+	}
+	if tracked {
+		args = []string{"ls-files", "-z"}
+		n++
+	}
+	if n != 1 {
+		return nil, errors.New("must specify exactly one of -git-changed, -git-staged and -git-tracked")
+	}
+	args = append(append(args, "--"), pathspecs...)
+	out, err := runGit(".", args...)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, f := range strings.Split(string(out), "\x00") {
+		if f == "" {
+			continue
+		}
+		// The index may list files that have since been deleted
+		// from the working tree.
+		if _, err := os.Lstat(f); os.IsNotExist(err) {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
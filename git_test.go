@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRepo is a temporary git repository.
+type testRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	r := &testRepo{t, t.TempDir()}
+	r.git("init", "-q")
+	return r
+}
+
+func (r *testRepo) write(name, text string) {
+	fname := filepath.Join(r.dir, name)
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := saveFile(fname, []byte(text)); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *testRepo) git(args ...string) {
+	args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+	if _, err := runGit(r.dir, args...); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func TestChangedSince(t *testing.T) {
+	r := newTestRepo(t)
+	r.write("a.c", "a;\nb;\nc;\n")
+	r.git("add", "a.c")
+	r.git("commit", "-q", "-m", "base")
+	r.write("a.c", "a;\nB;\nc;\nd;\n")
+	r.write("new.c", "x;\n")
+
+	for _, c := range []struct {
+		fname string
+		want  string
+	}{
+		{"a.c", "[{2 2} {4 4}]"},
+		{"new.c", "[]"},
+	} {
+		got, err := changedSince("HEAD", filepath.Join(r.dir, c.fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != c.want || (c.fname == "new.c" && got != nil) {
+			t.Errorf("changedSince(%s): got %#v, expecting %s", c.fname, got, c.want)
+		}
+	}
+	if _, err := changedSince("no-such-rev", filepath.Join(r.dir, "a.c")); err == nil || !strings.Contains(err.Error(), "no-such-rev") {
+		t.Errorf("changedSince(no-such-rev): got error %v", err)
+	}
+}
+
+func TestGitFiles(t *testing.T) {
+	r := newTestRepo(t)
+	r.write("a.c", "a;\n")
+	r.write("b.c", "b;\n")
+	r.write("gone.c", "c;\n")
+	r.write("removed.c", "r;\n")
+	r.write("sub/d.h", "d;\n")
+	r.git("add", ".")
+	r.git("commit", "-q", "-m", "base")
+	r.write("a.c", "A;\n")
+	r.write("sub/d.h", "D;\n")
+	r.write("sub/e.c", "e;\n")
+	r.write("untracked.c", "u;\n")
+	r.git("add", "sub/e.c")
+	r.git("rm", "-q", "gone.c")
+	r.write("staged.c", "s;\n")
+	r.git("add", "staged.c")
+	for _, name := range []string{"removed.c", "staged.c"} {
+		// Deleted from the working tree only.
+		if err := os.Remove(filepath.Join(r.dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, c := range []struct {
+		dir       string
+		changed   string
+		staged    bool
+		tracked   bool
+		pathspecs []string
+		want      string
+	}{
+		{".", "HEAD", false, false, nil, "[a.c sub/d.h sub/e.c]"},
+		{".", "", true, false, nil, "[sub/e.c]"},
+		{".", "", false, true, nil, "[a.c b.c sub/d.h sub/e.c]"},
+		{".", "", false, true, []string{"*.c"}, "[a.c b.c sub/e.c]"},
+		{"sub", "HEAD", false, false, nil, "[d.h e.c]"},
+		{"sub", "", false, true, []string{"*.h"}, "[d.h]"},
+	} {
+		if err := os.Chdir(filepath.Join(r.dir, c.dir)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := gitFiles(c.changed, c.staged, c.tracked, c.pathspecs)
+		if err != nil {
+			t.Errorf("gitFiles(%+v): %v", c, err)
+			continue
+		}
+		if fmt.Sprint(got) != c.want {
+			t.Errorf("gitFiles(%+v): got %v, expecting %s", c, got, c.want)
+		}
+	}
+
+	if _, err := gitFiles("HEAD", true, false, nil); err == nil {
+		t.Errorf("gitFiles with two flags: got no error")
+	}
+}
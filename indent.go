@@ -0,0 +1,160 @@
+package main
+
+import "strings"
+
+// leaves returns the leaves of tree n in order.
+func leaves(n *node) []*node {
+	var result []*node
+	perNode(n, func(c *node) {
+		if c.children == nil {
+			result = append(result, c)
+		}
+	})
+	return result
+}
+
+// spansLines returns true iff the text of n, not counting spaces
+// before its first token, spans more than one line.
+func spansLines(n *node) bool {
+	for i, leaf := range leaves(n) {
+		for _, t := range leaf.token.prefix {
+			if strings.Contains(t.text, "\n") && (i > 0 || t.ttype != SPACE) {
+				return true
+			}
+		}
+		for _, t := range leaf.token.suffix {
+			if strings.Contains(t.text, "\n") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reindent returns a copy of replacement in which every line after the
+// first is indented by indent plus its indentation relative to the
+// first line of replacement.  Spaces before the first line are
+// dropped.
+func reindent(replacement *node, indent string) *node {
+	r := clone(replacement)
+	all := leaves(r)
+	first := all[0].token
+	base := ""
+	if len(first.prefix) > 0 {
+		base = indentation(first.prefix[len(first.prefix)-1].text)
+	}
+	// The first line goes where the match starts, which is already
+	// indented.
+	var prefix []token
+	for _, t := range first.prefix {
+		if t.ttype != SPACE {
+			prefix = append(prefix, t)
+		}
+	}
+	all[0].token.prefix = prefix
+
+	lineStart := false
+	for _, leaf := range all {
+		// Copy trivia so that it is not shared with replacement.
+		leaf.token.prefix, lineStart = reindentTrivia(leaf.token.prefix, indent, base, lineStart, leaf.token.ttype != END)
+		leaf.token.suffix, lineStart = reindentTrivia(leaf.token.suffix, indent, base, lineStart, false)
+	}
+	return r
+}
+
+// reindentTrivia returns a copy of trivia in which the indentation of
+// every line that starts in trivia is set as described for reindent.
+// lineStart is true if trivia starts a line, and beforeToken is true if
+// a token follows trivia.  A line comment ends its line, so the space
+// after it (which is added if missing) is indentation.  The second
+// result is true if the text that follows trivia starts a line.
+func reindentTrivia(trivia []token, indent, base string, lineStart, beforeToken bool) ([]token, bool) {
+	var result []token
+	space := func(ind string) token {
+		return token{ttype: SPACE, text: indent + ind[commonPrefix(ind, base):]}
+	}
+	for _, t := range trivia {
+		switch {
+		case t.ttype == SPACE && strings.Contains(t.text, "\n"):
+			nl := strings.LastIndex(t.text, "\n")
+			t.text = t.text[:nl+1] + space(t.text[nl+1:]).text
+			lineStart = false
+		case t.ttype == SPACE && lineStart:
+			t.text = space(t.text).text
+			lineStart = false
+		case t.ttype == COMMENT:
+			if lineStart {
+				result = append(result, space(""))
+			}
+			lineStart = strings.HasSuffix(t.text, "\n")
+		}
+		result = append(result, t)
+	}
+	if lineStart && beforeToken {
+		result = append(result, space(""))
+		lineStart = false
+	}
+	return result, lineStart
+}
+
+// indentation returns the spaces and tabs at the start of the last line
+// of text.
+func indentation(text string) string {
+	line := text[strings.LastIndex(text, "\n")+1:]
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// commonPrefix returns the length of the common prefix of a and b.
+func commonPrefix(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// lineIndent returns the indentation of the line on which the text of
+// leaf n starts.  It walks backwards through the tree from n until it
+// finds a newline.
+func lineIndent(n *node) string {
+	before := ""
+	add := func(text string) bool {
+		before = text + before
+		return strings.Contains(text, "\n")
+	}
+	addTrivia := func(list []token) bool {
+		for i := len(list) - 1; i >= 0; i-- {
+			if add(list[i].text) {
+				return true
+			}
+		}
+		return false
+	}
+	for leaf := n; leaf != nil; leaf = prevLeaf(leaf) {
+		if leaf != n && (addTrivia(leaf.token.suffix) || add(leaf.token.text)) {
+			break
+		}
+		if addTrivia(leaf.token.prefix) {
+			break
+		}
+	}
+	line := before[strings.LastIndex(before, "\n")+1:]
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// prevLeaf returns the leaf that precedes leaf n in its tree, or nil if
+// there is none.
+func prevLeaf(n *node) *node {
+	for n.parent != nil {
+		i := indexOf(n.parent.children, n)
+		if i > 0 {
+			n = n.parent.children[i-1]
+			for n.children != nil && len(n.children) > 0 {
+				n = n.children[len(n.children)-1]
+			}
+			return n
+		}
+		n = n.parent
+	}
+	return nil
+}
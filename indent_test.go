@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func TestLineIndent(t *testing.T) {
+	for _, c := range []struct {
+		input string
+		word  string
+		want  string
+	}{
+		{"x", "x", ""},
+		{"  x", "x", "  "},
+		{"a;\n    b; c;\n", "c", "    "},
+		{"f() {\n\tif (a) {\n\t\tg(b);\n\t}\n}", "g", "\t\t"},
+		{"f() {\n\tif (a) {\n\t\tg(b);\n\t}\n}", "b", "\t\t"},
+		{"/* c\n */ x", "x", " "},
+	} {
+		root := parse([]byte(c.input))
+		var target *node
+		for _, l := range leaves(root) {
+			if l.token.text == c.word {
+				target = l
+			}
+		}
+		if got := lineIndent(target); got != c.want {
+			t.Errorf("lineIndent(%q, %q): got %q, expecting %q", c.input, c.word, got, c.want)
+		}
+	}
+}
+
+func TestReindent(t *testing.T) {
+	for _, c := range []struct {
+		subject     string
+		pattern     string
+		replacement string
+		output      string
+	}{
+		{
+			"void f() {\n    if (x) {\n        free(p);\n    }\n}",
+			"free($p);",
+			"if ($p) {\n  release($p);\n  $p = NULL;\n}",
+			"void f() {\n    if (x) {\n        if (p) {\n          release(p);\n          p = NULL;\n        }\n    }\n}",
+		},
+		{
+			// Relative indentation is kept when the whole
+			// replacement is indented.
+			"\tfree(p);",
+			"free($p);",
+			"    if ($p) {\n        release($p);\n    }",
+			"\tif (p) {\n\t    release(p);\n\t}",
+		},
+		{
+			"x = f(a);",
+			"f($a)",
+			"g(\n  $a)",
+			"x = g(\n  a);",
+		},
+		{
+			// A line comment ends its line.
+			"{\n    f(a);\n}",
+			"f($a);",
+			"g($a); // c\nh($a);",
+			"{\n    g(a); // c\n    h(a);\n}",
+		},
+		{
+			"{\n    f(a);\n}",
+			"f($a);",
+			"g($a);\n  // c\n  h($a);",
+			"{\n    g(a);\n      // c\n      h(a);\n}",
+		},
+		{
+			"{\n    f(a);\n}",
+			"f($a);",
+			"// c\ng($a);",
+			"{\n    // c\n    g(a);\n}",
+		},
+	} {
+		r := &rule{pattern: parsePattern([]byte(c.pattern), ""), replacement: parsePattern([]byte(c.replacement), "")}
+		sub := parse([]byte(c.subject))
+		replace(sub, r)
+		if got := string(sub.serialize()); got != c.output {
+			t.Errorf("replace %q by %q in %q:\ngot:\n%s\nexpecting:\n%s", c.pattern, c.replacement, c.subject, got, c.output)
+		}
+	}
+
+	// Replacement is inserted as written if keepIndent is set.
+	r := &rule{pattern: parse([]byte("f();")), replacement: parse([]byte("g();\nh();")), keepIndent: true}
+	sub := parse([]byte("{\n  f();\n}"))
+	replace(sub, r)
+	if got, want := string(sub.serialize()), "{\n  g();\nh();\n}"; got != want {
+		t.Errorf("replace with keepIndent: got %q, expecting %q", got, want)
+	}
+}
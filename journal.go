@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// journalEntry records the original contents of a file edited in place,
+// along with a hash of the edited contents so that undo can detect
+// later changes.
+type journalEntry struct {
+	File     string `json:"file"`     // Absolute path
+	Original []byte `json:"original"` // Contents before the edit
+	Edited   string `json:"edited"`   // Hex SHA-256 of contents after the edit
+}
+
+// journal is a file with one JSON journalEntry per line.
+type journal struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+// createJournal creates (or truncates) the journal file fname.
+func createJournal(fname string) (*journal, error) {
+	// The journal holds the contents of every edited file, so only
+	// the user may read it.
+	f, err := os.OpenFile(fname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{f, json.NewEncoder(f)}, nil
+}
+
+// record adds an entry for file fname, which is about to be changed
+// from original to edited.  The entry is flushed to disk before record
+// returns.
+func (j *journal) record(fname string, original, edited []byte) error {
+	abs, err := filepath.Abs(fname)
+	if err != nil {
+		return err
+	}
+	if err := j.enc.Encode(journalEntry{abs, original, hash(edited)}); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *journal) Close() error { return j.f.Close() }
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// undo restores the files recorded in journal fname to their original
+// contents.  Nothing is restored if any file has changed since it was
+// edited.  All new contents are written to temporary files before any
+// file is replaced.  Files are replaced one at a time; if replacing one
+// fails, the files already restored are given back their edited
+// contents, as far as that is possible.
+func undo(fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// If a file was edited more than once, the first entry holds the
+	// original and the last the latest edit.
+	var order []string
+	original := make(map[string][]byte)
+	edited := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for line := 1; scanner.Scan(); line++ {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("%s:%d: %v", fname, line, err)
+		}
+		if _, ok := original[e.File]; !ok {
+			order = append(order, e.File)
+			original[e.File] = e.Original
+		}
+		edited[e.File] = e.Edited
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	current := make(map[string][]byte)
+	for _, file := range order {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if hash(data) != edited[file] {
+			return fmt.Errorf("%s has changed since it was edited; not undoing any edits", file)
+		}
+		current[file] = data
+	}
+
+	var temps []string
+	defer func() {
+		for _, t := range temps {
+			os.Remove(t)
+		}
+	}()
+	for _, file := range order {
+		tmp, err := writeTemp(file, original[file])
+		if err != nil {
+			return err
+		}
+		temps = append(temps, tmp)
+	}
+	for i, file := range order {
+		if err := rename(temps[i], file); err != nil {
+			for _, done := range order[:i] {
+				if rerr := saveFile(done, current[done]); rerr != nil {
+					return fmt.Errorf("%v; could not roll back %s: %v", err, done, rerr)
+				}
+			}
+			return fmt.Errorf("%v; no edits undone", err)
+		}
+	}
+	return nil
+}
+
+// rename is os.Rename, replaceable by tests of a failed undo.
+var rename = os.Rename
+
+// saveBackup saves data, the original contents of fname, to backup.
+// The backup gets the permissions of fname.  An existing backup is
+// never replaced, since it may hold the only copy of an older original.
+func saveBackup(fname, backup string, data []byte) error {
+	tmp, err := writeTemp(fname, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	// Unlike a rename, a link fails if backup exists.
+	if err := os.Link(tmp, backup); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("backup %s already exists; not editing %s", backup, fname)
+		}
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes data to a new temporary file in the directory of
+// fname and returns its name.  The temporary file gets the permissions
+// of fname if it exists.
+func writeTemp(fname string, data []byte) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname)+"-tmp")
+	if err != nil {
+		return "", err
+	}
+	if info, serr := os.Stat(fname); serr == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
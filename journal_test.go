@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUndo(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.c"), filepath.Join(dir, "b.c")
+	read := func(fname string) string {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	// edit records an edit in j and makes it.
+	edit := func(j *journal, fname, text string) {
+		if err := j.record(fname, []byte(read(fname)), []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveFile(fname, []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, fname := range []string{a, b} {
+		if err := ioutil.WriteFile(fname, []byte("old "+filepath.Base(fname)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jname := filepath.Join(dir, "journal")
+	j, err := createJournal(jname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit(j, a, "new a")
+	edit(j, b, "new b")
+	edit(j, a, "newer a")
+	j.Close()
+
+	// A file changed after the edit blocks the whole undo.
+	saveFile(b, []byte("changed b"))
+	if err := undo(jname); err == nil || !strings.Contains(err.Error(), "b.c has changed") {
+		t.Errorf("undo after change: got error %v", err)
+	}
+	if got := read(a); got != "newer a" {
+		t.Errorf("undo after change restored a: got %q", got)
+	}
+
+	saveFile(b, []byte("new b"))
+	if err := undo(jname); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(a) + ", " + read(b); got != "old a.c, old b.c" {
+		t.Errorf("undo: got %q, expecting originals", got)
+	}
+	if info, err := os.Stat(a); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("undo: got mode %v, %v, expecting 0755", info.Mode(), err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*-tmp*")); len(files) > 0 {
+		t.Errorf("undo left temporary files %v", files)
+	}
+
+	ioutil.WriteFile(jname, []byte("{}\nnot json\n"), 0644)
+	if err := undo(jname); err == nil || !strings.Contains(err.Error(), "journal:2:") {
+		t.Errorf("undo with bad journal: got error %v", err)
+	}
+}
+
+func TestUndoRollback(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.c"), filepath.Join(dir, "b.c")
+	jname := filepath.Join(dir, "journal")
+	j, err := createJournal(jname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fname := range []string{a, b} {
+		if err := j.record(fname, []byte("old"), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveFile(fname, []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+	if info, err := os.Stat(jname); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("journal: got mode %v, %v, expecting 0600", info.Mode(), err)
+	}
+
+	defer func() { rename = os.Rename }()
+	rename = func(from, to string) error {
+		if to == b {
+			return fmt.Errorf("cannot replace %s", to)
+		}
+		return os.Rename(from, to)
+	}
+	if err := undo(jname); err == nil || !strings.Contains(err.Error(), "no edits undone") {
+		t.Errorf("failed undo: got error %v", err)
+	}
+	for _, fname := range []string{a, b} {
+		if data, err := ioutil.ReadFile(fname); err != nil || string(data) != "new" {
+			t.Errorf("failed undo: got %s = %q, %v, expecting edited contents", filepath.Base(fname), data, err)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*-tmp*")); len(files) > 0 {
+		t.Errorf("failed undo left temporary files %v", files)
+	}
+}
+
+func TestSaveBackup(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "a.c")
+	if err := ioutil.WriteFile(fname, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveBackup(fname, fname+".orig", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(fname + ".orig")
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("saveBackup: got mode %v, %v, expecting 0600", info.Mode(), err)
+	}
+	err = saveBackup(fname, fname+".orig", []byte("older"))
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("saveBackup over existing backup: got error %v", err)
+	}
+	if data, _ := ioutil.ReadFile(fname + ".orig"); string(data) != "old" {
+		t.Errorf("saveBackup over existing backup: got %q, expecting \"old\"", data)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*-tmp*")); len(files) > 0 {
+		t.Errorf("saveBackup left temporary files %v", files)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// lineFlag holds the line ranges given by -lines flags, by file.  Ranges
+// given without a file name are stored under "" and apply to every
+// input.
+type lineFlag map[string][]lineRange
+
+func (f lineFlag) String() string { return "" }
+
+// Set adds the ranges in a value of the form [file:]first-last,... to f.
+// A range may also be a single line.
+func (f lineFlag) Set(value string) error {
+	fname, list := "", value
+	if i := strings.LastIndex(value, ":"); i >= 0 {
+		fname, list = filepath.Clean(value[:i]), value[i+1:]
+	}
+	for _, item := range strings.Split(list, ",") {
+		r, err := parseLineRange(item)
+		if err != nil {
+			return err
+		}
+		f[fname] = append(f[fname], r)
+	}
+	return nil
+}
+
+// parseLineRange parses a range of the form first-last or a single line
+// number.
+func parseLineRange(text string) (lineRange, error) {
+	first, last := text, text
+	if i := strings.Index(text, "-"); i >= 0 {
+		first, last = text[:i], text[i+1:]
+	}
+	f, err1 := strconv.Atoi(first)
+	l, err2 := strconv.Atoi(last)
+	if err1 != nil || err2 != nil || f < 1 || l < f {
+		return lineRange{}, fmt.Errorf("bad line range %q: must be first-last with 1 <= first <= last", text)
+	}
+	return lineRange{f, l}, nil
+}
+
+// lines returns the lines of fname to which f restricts matches, or nil
+// if there is no restriction.
+func (f lineFlag) lines(fname string) []lineRange {
+	if len(f) == 0 {
+		return nil
+	}
+	result := append([]lineRange{}, f[""]...)
+	if fname != "" {
+		result = append(result, f[filepath.Clean(fname)]...)
+	}
+	return result
+}
+
+// hunkHeader matches the header of a hunk of unified diff output and
+// captures the first line and line count of the new side.
+var hunkHeader = regexp.MustCompile(`(?m)^@@ -[0-9,]+ \+([0-9]+)(?:,([0-9]+))? @@`)
+
+// diffLines returns the lines of the new side of unified diff output
+// that were added or changed.  Hunks that only delete lines are ignored.
+func diffLines(diff []byte) []lineRange {
+	result := []lineRange{}
+	for _, m := range hunkHeader.FindAllSubmatch(diff, -1) {
+		first, _ := strconv.Atoi(string(m[1]))
+		count := 1
+		if len(m[2]) > 0 {
+			count, _ = strconv.Atoi(string(m[2]))
+		}
+		if count > 0 {
+			result = append(result, lineRange{first, first + count - 1})
+		}
+	}
+	return result
+}
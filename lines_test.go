@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLineFlag(t *testing.T) {
+	f := lineFlag{}
+	for _, v := range []string{"a.c:1-2,5", "./b.c:3-3", "7-8", "dir/a.c:10"} {
+		if err := f.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	for _, c := range []struct {
+		fname string
+		want  string
+	}{
+		{"a.c", "[{7 8} {1 2} {5 5}]"},
+		{"b.c", "[{7 8} {3 3}]"},
+		{"dir/../dir/a.c", "[{7 8} {10 10}]"},
+		{"", "[{7 8}]"},
+	} {
+		if got := fmt.Sprint(f.lines(c.fname)); got != c.want {
+			t.Errorf("lines(%q): got %s, expecting %s", c.fname, got, c.want)
+		}
+	}
+	if got := (lineFlag{}).lines("a.c"); got != nil {
+		t.Errorf("empty lineFlag: got %v, expecting nil", got)
+	}
+
+	for _, v := range []string{"a.c:", "a.c:x-2", "0-3", "5-4", "1-2-3"} {
+		if err := (lineFlag{}).Set(v); err == nil {
+			t.Errorf("Set(%q): got no error", v)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	diff := `diff --git a/a.c b/a.c
+index 1..2 100644
+--- a/a.c
++++ b/a.c
+@@ -2 +2 @@ void f() {
+-  f(2);
++  f(22);
+@@ -5,0 +6,2 @@
++  x;
++  y;
+@@ -9,2 +10,0 @@
+-  z;
+-  w;
+`
+	if got, want := fmt.Sprint(diffLines([]byte(diff))), "[{2 2} {6 7}]"; got != want {
+		t.Errorf("diffLines: got %s, expecting %s", got, want)
+	}
+	if got := diffLines(nil); got == nil || len(got) != 0 {
+		t.Errorf("diffLines(nil): got %#v, expecting empty list", got)
+	}
+}
+
+func TestInLines(t *testing.T) {
+	const subject = "f(1);\nf(2,\n  3);\n/* f(4) */ f(5);\n"
+	for _, c := range []struct {
+		lines  []lineRange
+		output string
+	}{
+		{nil, "g(1);\ng(2,\n  3);\n/* f(4) */ g(5);\n"},
+		{[]lineRange{}, subject},
+		{[]lineRange{{1, 1}}, "g(1);\nf(2,\n  3);\n/* f(4) */ f(5);\n"},
+		{[]lineRange{{3, 3}}, "f(1);\ng(2,\n  3);\n/* f(4) */ f(5);\n"},
+		{[]lineRange{{4, 9}}, "f(1);\nf(2,\n  3);\n/* f(4) */ g(5);\n"},
+	} {
+		r := &rule{pattern: parse([]byte("f($x*)")), replacement: parse([]byte("g($x*)")), lines: c.lines}
+		sub := parse([]byte(subject))
+		replace(sub, r)
+		if got := string(sub.serialize()); got != c.output {
+			t.Errorf("lines %v: got %q, expecting %q", c.lines, got, c.output)
+		}
+	}
+
+	// Comment rules check the lines of each comment.
+	r, err := parseRule([]byte("/* f($x) */\n---\n/* g($x) */\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.lines = []lineRange{{2, 2}}
+	sub := parse([]byte("/* f(1) */\n/* f(2) */\n"))
+	replace(sub, r)
+	if got, want := string(sub.serialize()), "/* f(1) */\n/* g(2) */\n"; got != want {
+		t.Errorf("comment rule: got %q, expecting %q", got, want)
+	}
+}
@@ -1,23 +1,62 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"path/filepath"
-	"regexp"
+	"strconv"
+	"strings"
 )
 
 var (
 	flagHelp = flag.Bool("help", false, "If true print a help message and exit.")
 	flagEdit = flag.Bool("edit", false, "If true, edit files in place.")
 	flagFile = flag.String("apply", "",
-		"If non-empty, pattern and replacement are read from the specified file.  The pattern comes first and is separated from the replacement by a line that consists entirely of dashes (at least three dashes are required).")
+		"If non-empty, pattern and replacement are read from the specified file.  The pattern comes first and is separated from the replacement by a line that consists entirely of dashes (at least three dashes are required).  Another such line may be followed by directives that restrict matches.")
+	flagDump = flag.String("dump", "",
+		"If non-empty, print the parse trees of the pattern, the replacement and the input instead of replacing.  Must be \"tree\" for an indented listing or \"dot\" for Graphviz DOT.")
+	flagExplain = flag.String("explain", "",
+		"If non-empty, must have the form file:line:col.  Explain step by step how the pattern is compared against the input at that position instead of replacing.")
+	flagCommutative = flag.String("commutative", "",
+		"If non-empty, a comma-separated list of binary operators (or \"all\") whose operands may match in either order, e.g., \"==,!=\".")
+	flagReindent = flag.Bool("reindent", true,
+		"If true, indent every line of a multi-line replacement to fit the line on which the match starts.")
+	flagAssociative = flag.String("associative", "",
+		"If non-empty, a comma-separated list of binary operators (or \"all\") whose chains, such as a + b + c, are matched as flat lists so that a pattern can match any run of operands.")
+	flagFormatCmd = flag.String("format-cmd", "",
+		"If non-empty, a formatter command (e.g., \"clang-format\") through which each rewritten input is piped, restricted to the lines changed by replacements.  Inputs without replacements are left alone.")
+	flagFormatLines = flag.String("format-lines", "--lines=%d:%d",
+		"Format of the argument passed to the -format-cmd command for each range of changed lines.  Must contain two %d verbs for the first and last line.")
+	flagDiffBase = flag.String("diff-base", "",
+		"If non-empty, a git revision.  Only matches that overlap lines added or changed since that revision (according to git diff) are replaced.")
+	flagLines      = lineFlag{}
+	flagGitChanged = flag.String("git-changed", "",
+		"If non-empty, a git revision.  Instead of listing files, process the files under the current directory that were changed since that revision.  Remaining arguments are git pathspecs that limit the files.")
+	flagGitStaged = flag.Bool("git-staged", false,
+		"If true, instead of listing files, process the files under the current directory that have staged changes.  Remaining arguments are git pathspecs that limit the files.")
+	flagGitTracked = flag.Bool("git-tracked", false,
+		"If true, instead of listing files, process the files under the current directory that git tracks.  Remaining arguments are git pathspecs that limit the files.")
+	flagBackup = flag.String("backup", "",
+		"If non-empty, with -edit, save the original contents of each edited file to the file name plus this suffix, e.g., \".orig\".  Stop if such a file already exists.")
+	flagJournal = flag.String("journal", "",
+		"If non-empty, with -edit, record the original contents of every edited file in this journal file, which -undo can use to restore them.")
+	flagFilesFrom = flag.String("files-from", "",
+		"If non-empty, read the names of files to process, one per line, from this file (\"-\" for standard input) in addition to those on the command line.")
+	flagNul = flag.Bool("0", false,
+		"If true, names read by -files-from are separated by NUL characters instead of newlines.")
+	flagUndo = flag.String("undo", "",
+		"If non-empty, restore the files recorded in this journal (written by -journal) to their original contents instead of replacing.")
 )
 
+func init() {
+	flag.Var(flagLines, "lines",
+		"Only replace matches that overlap the specified lines, given as [file:]first-last[,first-last...].  May be repeated.  Ranges without a file apply to every input.")
+}
+
 func usage(dst io.Writer) {
 	fmt.Fprint(dst, `Usage
 
@@ -31,12 +70,67 @@ treewrite -apply _filename_ files...
 
     The contents of _filename_ should be pattern followed by replacement,
     separated by a line containing entirely of dashes (at least three
-    dashes are required).
+    dashes are required).  Another such line may follow the replacement,
+    followed by directives that restrict matches, one per line:
+
+        where $var [not] contains _pattern_
+        where $var [not] matches _pattern_
+        where $var [not] equals $other
+        where $var =~ /_regexp_/
+        where $var !~ /_regexp_/
+        inside: _pattern_
+        not-inside: _pattern_
+        commutative [_operators_]
+        associative [_operators_]
+        comment: _comment_
+        sigil: _text_
+        ensure-line: _line_
+        remove-line: _line_ [unless-used _words_...]
 
 treewrite -edit ...
     Read from each of the specified files (there must be at least one), apply
     the replacement, and write the result back to source file.
 
+treewrite -format-cmd _command_ ...
+    Pipe each rewritten input through _command_, passing one argument per
+    range of changed lines (see -format-lines), so that only the rewritten
+    code is reformatted, e.g., -format-cmd clang-format.
+
+treewrite -lines [_file_:]_first_-_last_[,...] ...
+treewrite -diff-base _rev_ ...
+    Only replace matches that overlap the specified lines, or the lines
+    that git diff reports as added or changed since revision _rev_.
+
+treewrite -git-changed _rev_ | -git-staged | -git-tracked ... [_pathspec_...]
+    Process the files under the current directory that were changed since
+    revision _rev_, that have staged changes, or that git tracks, instead of
+    the files listed on the command line.  Any remaining arguments are git
+    pathspecs (e.g., '*.c') that limit the files.  Deleted files are skipped.
+
+treewrite -files-from _list_ [-0] ...
+    Also process the files named in _list_ (one per line, or separated by
+    NUL characters with -0), which may be "-" for standard input.
+
+treewrite -edit -backup _suffix_ ...
+treewrite -edit -journal _journal_ ...
+treewrite -undo _journal_
+    With -backup, save the original of each edited file to the file name
+    plus _suffix_ (e.g., .orig); an existing backup is never overwritten.
+    With -journal, record the originals of all edited files in _journal_;
+    -undo then restores all of them.
+
+treewrite -dump tree|dot ...
+    Print the parse trees for the pattern, the replacement and each input
+    instead of replacing.  "tree" prints an indented listing that shows the
+    type, line:column and attached comments/spaces of every token.  "dot"
+    prints Graphviz input (e.g., pipe through "dot -Tsvg").
+
+treewrite -explain _file_:_line_:_col_ ...
+    Explain how the pattern is compared against the token at the specified
+    position of _file_, reporting which pattern element fails to match at
+    each enclosing level of the parse tree, or which part of the rule
+    (where, inside, not-inside, comment) rejects a match.
+
 `)
 }
 
@@ -47,37 +141,102 @@ func main() {
 		os.Exit(0)
 	}
 	args := flag.Args()
-	var pattern, replacement []byte
+	if *flagUndo != "" {
+		reportError(undo(*flagUndo))
+		return
+	}
+	var r *rule
 	if *flagFile != "" {
-		pattern, replacement = splitFile(*flagFile)
+		var err error
+		r, err = readRule(*flagFile)
+		reportError(err)
 	} else {
 		if len(args) < 2 {
 			usage(os.Stderr)
 			os.Exit(1)
 		}
-		pattern = []byte(args[0])
-		replacement = []byte(args[1])
+		r = &rule{pattern: parsePattern([]byte(args[0]), ""), replacement: parsePattern([]byte(args[1]), "")}
 		args = args[2:]
 	}
+	if *flagCommutative != "" {
+		reportError(r.addCommutative(*flagCommutative))
+	}
+	r.keepIndent = !*flagReindent
+	if *flagAssociative != "" {
+		reportError(r.addAssociative(*flagAssociative))
+	}
+	pat, rep := r.pattern, r.replacement
+
+	if *flagDump != "" {
+		dumpAll(*flagDump, pat, rep, args)
+		return
+	}
+	if *flagExplain != "" {
+		fname, line, column, err := parseLocation(*flagExplain)
+		reportError(err)
+		data, err := ioutil.ReadFile(fname)
+		reportError(err)
+		explain(os.Stdout, parse(data), r, line, column)
+		return
+	}
+
+	errs, warnings := r.validate()
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+	for _, e := range errs {
+		fmt.Fprintln(os.Stderr, "error:", e)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
 
-	pat := parse(pattern)
-	rep := parse(replacement)
+	if *flagFilesFrom != "" {
+		if *flagGitChanged != "" || *flagGitStaged || *flagGitTracked {
+			reportError(errors.New("-files-from cannot be combined with -git-changed, -git-staged or -git-tracked"))
+		}
+		files, err := readFileList(*flagFilesFrom, *flagNul)
+		reportError(err)
+		args = append(args, files...)
+		if len(args) == 0 {
+			// Do not fall back to standard input.
+			return
+		}
+	}
+	if *flagGitChanged != "" || *flagGitStaged || *flagGitTracked {
+		files, err := gitFiles(*flagGitChanged, *flagGitStaged, *flagGitTracked, args)
+		reportError(err)
+		if len(files) == 0 {
+			// Do not fall back to standard input.
+			return
+		}
+		args = files
+	}
+	if *flagDiffBase != "" && len(flagLines) > 0 {
+		reportError(errors.New("-diff-base and -lines cannot be combined"))
+	}
+	if *flagDiffBase != "" && len(args) == 0 {
+		reportError(errors.New("Must specify at least one file with -diff-base flag."))
+	}
 
 	if !*flagEdit {
+		if *flagBackup != "" || *flagJournal != "" {
+			reportError(errors.New("-backup and -journal require -edit"))
+		}
 		if len(args) == 0 {
 			data, err := ioutil.ReadAll(os.Stdin)
 			reportError(err)
-			input := parse(data)
-			replace(input, pat, rep)
-			os.Stdout.Write(input.serialize())
+			out, err := rewrite("", data, r)
+			reportError(err)
+			os.Stdout.Write(out)
 			return
 		}
 		for _, fname := range args {
 			data, err := ioutil.ReadFile(fname)
 			reportError(err)
-			input := parse(data)
-			replace(input, pat, rep)
-			os.Stdout.Write(input.serialize())
+			out, err := rewrite(fname, data, r)
+			reportError(err)
+			os.Stdout.Write(out)
 		}
 		return
 	}
@@ -85,46 +244,154 @@ func main() {
 	if len(args) == 0 {
 		reportError(errors.New("Must specify at least one file with -edit flag."))
 	}
+	var j *journal
+	if *flagJournal != "" {
+		var err error
+		j, err = createJournal(*flagJournal)
+		reportError(err)
+		defer j.Close()
+	}
 	for _, fname := range args {
 		data, err := ioutil.ReadFile(fname)
 		reportError(err)
-		input := parse(data)
-		replace(input, pat, rep)
-		reportError(saveFile(fname, input.serialize()))
+		out, err := rewrite(fname, data, r)
+		reportError(err)
+		if bytes.Equal(out, data) {
+			continue
+		}
+		if *flagBackup != "" {
+			reportError(saveBackup(fname, fname+*flagBackup, data))
+		}
+		if j != nil {
+			reportError(j.record(fname, data, out))
+		}
+		reportError(saveFile(fname, out))
 	}
 }
 
-// splitFile extracts pattern and replacement text from named file.
-func splitFile(file string) ([]byte, []byte) {
-	data, err := ioutil.ReadFile(file)
-	reportError(err)
-	re := regexp.MustCompile("(?m)^---+\n")
-	m := re.FindIndex(data)
-	if m == nil {
-		reportError(errors.New("no separator line in " + file))
-		os.Exit(1)
+// rewrite applies r to data, the contents of file fname (empty for
+// standard input), and returns the result.  If any replacements were
+// made, the line edits of r are applied and the result is piped through
+// the -format-cmd formatter.
+func rewrite(fname string, data []byte, r *rule) ([]byte, error) {
+	lines := flagLines.lines(fname)
+	if *flagDiffBase != "" {
+		var err error
+		if lines, err = changedSince(*flagDiffBase, fname); err != nil {
+			return nil, err
+		}
+	}
+	if lines != nil {
+		// Restrict a copy of r to the lines of this input.
+		restricted := *r
+		restricted.lines = lines
+		r = &restricted
+	}
+
+	input := parse(data)
+	if replace(input, r) == 0 {
+		return input.serialize(), nil
+	}
+	out := input.serialize()
+	ranges := changedLines(input)
+	if len(r.fileEdits) > 0 {
+		out, ranges = editFile(input, out, r.fileEdits, ranges)
 	}
-	return data[:m[0]], data[m[1]:]
+	if *flagFormatCmd == "" || len(ranges) == 0 {
+		return out, nil
+	}
+	return format(*flagFormatCmd, *flagFormatLines, out, ranges)
 }
 
-// saveFile saves data to fname by writing to a temporary file and renaming.
-func saveFile(fname string, data []byte) error {
-	tmp, err := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname)+"-tmp")
+// dumpAll prints the parse trees for pattern, replacement and inputs
+// (standard input if args is empty) in the specified format.
+func dumpAll(format string, pat, rep *node, args []string) {
+	var write func(name string, n *node)
+	switch format {
+	case "tree":
+		write = func(name string, n *node) {
+			fmt.Printf("# %s\n", name)
+			dumpTree(os.Stdout, n)
+		}
+	case "dot":
+		write = func(name string, n *node) {
+			dumpDot(os.Stdout, name, n)
+		}
+	default:
+		reportError(fmt.Errorf("unknown -dump format %q (must be tree or dot)", format))
+	}
+
+	write("pattern", pat)
+	write("replacement", rep)
+	if len(args) == 0 {
+		data, err := ioutil.ReadAll(os.Stdin)
+		reportError(err)
+		write("stdin", parse(data))
+		return
+	}
+	for _, fname := range args {
+		data, err := ioutil.ReadFile(fname)
+		reportError(err)
+		write(fname, parse(data))
+	}
+}
+
+// readFileList returns the file names listed in fname (standard input if
+// fname is "-"), separated by newlines or, if nul is true, by NUL
+// characters.  Empty names are skipped.
+func readFileList(fname string, nul bool) ([]string, error) {
+	var data []byte
+	var err error
+	if fname == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(fname)
+	}
 	if err != nil {
-		return err
+		return nil, err
+	}
+	sep := "\n"
+	if nul {
+		sep = "\x00"
+	}
+	var files []string
+	for _, f := range strings.Split(string(data), sep) {
+		if !nul {
+			f = strings.TrimSuffix(f, "\r")
+		}
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// parseLocation splits a location of the form file:line:col.
+func parseLocation(loc string) (string, int, int, error) {
+	parts := strings.Split(loc, ":")
+	n := len(parts)
+	if n < 3 {
+		return "", 0, 0, fmt.Errorf("bad location %q: must be file:line:col", loc)
+	}
+	line, err1 := strconv.Atoi(parts[n-2])
+	column, err2 := strconv.Atoi(parts[n-1])
+	if err1 != nil || err2 != nil {
+		return "", 0, 0, fmt.Errorf("bad location %q: must be file:line:col", loc)
 	}
-	tmpName := tmp.Name()
-	defer os.Remove(tmpName)
-	_, err = tmp.Write(data)
+	return strings.Join(parts[:n-2], ":"), line, column, nil
+}
+
+// saveFile saves data to fname by writing to a temporary file and renaming.
+func saveFile(fname string, data []byte) error {
+	tmpName, err := writeTemp(fname, data)
 	if err != nil {
-		tmp.Close()
 		return err
 	}
-	err = tmp.Close()
-	if err != nil {
+	if err := os.Rename(tmpName, fname); err != nil {
+		os.Remove(tmpName)
 		return err
 	}
-	return os.Rename(tmpName, fname)
+	return nil
 }
 
 func reportError(err error) {
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadFileList(t *testing.T) {
+	for _, c := range []struct {
+		data string
+		nul  bool
+		want string
+	}{
+		{"a.c\nb c.c\n", false, "[a.c b c.c]"},
+		{"a.c\r\n\nb.c", false, "[a.c b.c]"},
+		{"a\nb.c\x00c.c\x00\x00", true, "[a\nb.c c.c]"},
+		{"", false, "[]"},
+	} {
+		fname := filepath.Join(t.TempDir(), "list")
+		if err := ioutil.WriteFile(fname, []byte(c.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files, err := readFileList(fname, c.nul)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(files); got != c.want {
+			t.Errorf("readFileList(%q, %v): got %q, expecting %s", c.data, c.nul, files, c.want)
+		}
+	}
+	if _, err := readFileList(filepath.Join(t.TempDir(), "missing"), false); err == nil {
+		t.Errorf("readFileList(missing): got no error")
+	}
+}
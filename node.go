@@ -11,6 +11,7 @@ type node struct {
 	depth    int     // Root has depth 0; others have depth == 1 + parent.depth
 	children []*node // List of chidlren for non-leaf node.
 	token            // Only used if children == nil
+	replaced bool    // True iff node was inserted by a replacement
 }
 
 func (n *node) addChild(c *node) {
@@ -58,6 +59,69 @@ func (root *node) serialize() []byte {
 	return result
 }
 
+// innerText returns the serialized form of list without the spaces and
+// comments attached before the first token and after the last token.
+func innerText(list []*node) string {
+	var leaves []token
+	for _, n := range list {
+		perNode(n, func(c *node) {
+			if c.children == nil {
+				leaves = append(leaves, c.token)
+			}
+		})
+	}
+	var result []byte
+	for i, t := range leaves {
+		if i > 0 {
+			for _, x := range t.prefix {
+				result = append(result, x.text...)
+			}
+		}
+		result = append(result, t.text...)
+		if i < len(leaves)-1 {
+			for _, x := range t.suffix {
+				result = append(result, x.text...)
+			}
+		}
+	}
+	return string(result)
+}
+
+// codeText returns the text of list like innerText, but without
+// comments.  Where comments are dropped between two tokens, the spaces
+// between them are reduced to a single space, if any.
+func codeText(list []*node) string {
+	var leaves []token
+	for _, n := range list {
+		perNode(n, func(c *node) {
+			if c.children == nil {
+				leaves = append(leaves, c.token)
+			}
+		})
+	}
+	var result []byte
+	for i, t := range leaves {
+		result = append(result, t.text...)
+		if i == len(leaves)-1 {
+			break
+		}
+		gap := append(append([]token(nil), t.suffix...), leaves[i+1].prefix...)
+		space, comment := "", false
+		for _, x := range gap {
+			if x.ttype == COMMENT {
+				comment = true
+			} else if x.ttype == SPACE {
+				space += x.text
+			}
+		}
+		if comment && space != "" {
+			space = " "
+		}
+		result = append(result, space...)
+	}
+	return string(result)
+}
+
 func perNode(n *node, fn func(*node)) {
 	fn(n)
 	for _, c := range n.children {
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"bytes"
+	"strings"
+)
+
 // parser implements recursive descent parsing.  We do not really parse
 // any particular language, but just look for common expression patterns
 // and ensure their structure is reflected in the generated parse tree.
@@ -12,6 +17,53 @@ func parse(input []byte) *node {
 	return p.root()
 }
 
+// parsePattern parses a pattern or replacement.  Unlike parse, $$name
+// and \$name stand for the literal text $name.  If sigil is neither
+// empty nor "$", variables start with sigil instead of $ (e.g., @@x),
+// and every $ is literal text.
+func parsePattern(input []byte, sigil string) *node {
+	custom := sigil != "" && sigil != "$"
+	if custom {
+		input = replaceSigil(input, sigil)
+	}
+	p := &parser{tok: newPatternTokenizer(input, !custom)}
+	return p.root()
+}
+
+// replaceSigil rewrites input that uses sigil to start variables into
+// the usual syntax: sigil becomes $ and $ becomes the escape $$.  An
+// escaped sigil (doubled or preceded by a backslash) is kept as
+// literal text.  A backslash before a $ is literal text too; the result
+// must be read without the \$ escape so that it does not pair with the
+// $$ that follows.
+func replaceSigil(input []byte, sigil string) []byte {
+	var out bytes.Buffer
+	s := string(input)
+	for len(s) > 0 {
+		switch {
+		case strings.HasPrefix(s, sigil+sigil):
+			out.WriteString(sigil)
+			s = s[2*len(sigil):]
+		case strings.HasPrefix(s, "\\"+sigil):
+			out.WriteString(sigil)
+			s = s[1+len(sigil):]
+		case strings.HasPrefix(s, sigil):
+			out.WriteByte('$')
+			s = s[len(sigil):]
+		case strings.HasPrefix(s, "\\$"):
+			out.WriteString("\\$$")
+			s = s[2:]
+		case s[0] == '$':
+			out.WriteString("$$")
+			s = s[1:]
+		default:
+			out.WriteByte(s[0])
+			s = s[1:]
+		}
+	}
+	return out.Bytes()
+}
+
 func (p *parser) root() *node {
 	n := &node{children: make([]*node, 0)}
 	p.readExprs(n, "")
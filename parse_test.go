@@ -18,6 +18,7 @@ func TestParse(t *testing.T) {
 		{"a(b,c)", "([a] [(] [b] [,] [c] [)])"},
 		{"a(b)(c)", "(([a] [(] [b] [)]) [(] [c] [)])"},
 		{"a(b(c))(d)", "(([a] [(] ([b] [(] [c] [)]) [)]) [(] [d] [)])"},
+		{"a[i]+b", "(([a] [[] [i] []]) [+] [b])"},
 		// Following exhibit right-associativity.
 		{"+-a", "([+] ([-] [a]))"},
 		{"a=b=c", "([a] [=] ([b] [=] [c]))"},
@@ -34,3 +35,18 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestReplaceSigil(t *testing.T) {
+	for _, c := range []struct {
+		input, sigil, output string
+	}{
+		{"f(@@x, $y)", "@@", "f($x, $$y)"},
+		{`@@@@x \@@y @@z*`, "@@", "@@x @@y $z*"},
+		{"%[a|b] %{upper(x)}", "%", "$[a|b] ${upper(x)}"},
+		{`\$x \@@y`, "@@", `\$$x @@y`},
+	} {
+		if got := string(replaceSigil([]byte(c.input), c.sigil)); got != c.output {
+			t.Errorf("replaceSigil(%q, %q): got %q, expecting %q", c.input, c.sigil, got, c.output)
+		}
+	}
+}
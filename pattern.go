@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"regexp"
+	"strings"
 )
 
 // pattern can be used to find occurrences of a list of pattern nodes
@@ -16,13 +18,34 @@ type pattern struct {
 	// Pattern objects per child (nil for tokens)
 	childpat []*pattern
 
+	// Word patterns per child (nil except for WVAR tokens and strings
+	// that refer to variables)
+	words []*wordPattern
+
+	// Patterns that must occur somewhere inside the nodes matched by
+	// a variable (nil except for variables with a contains clause)
+	within []*pattern
+
 	// A regular expression corresponding to list nodes.
 	// list[i] will correspond to re sub-match numbered i+1.
 	// (regexp sub-matches are numbered starting at 1).
 	re *regexp.Regexp
 
+	// re anchored at the start of the subject; see reach.
+	anchored *regexp.Regexp
+
 	// Every unique token is represented by a single rune in re.
 	runemap map[string]rune
+
+	// If non-nil, matches for which accept returns false are skipped.
+	accept func(match) bool
+
+	// True iff list must match the entire subject list.
+	full bool
+
+	// If non-nil, a pattern for list with the operands of a
+	// commutative operator swapped.  See allowSwap.
+	swapped *pattern
 }
 
 // makePattern returns a pattern for a specified pattern tree, If
@@ -33,10 +56,17 @@ func makePattern(p *node) *pattern {
 }
 
 func makeListPattern(list []*node, fullMatch bool, runemap map[string]rune) *pattern {
+	list, clauses := splitContains(list)
 	p := &pattern{
 		runemap:  runemap,
+		full:     fullMatch,
 		list:     list,
 		childpat: make([]*pattern, len(list)),
+		words:    make([]*wordPattern, len(list)),
+		within:   make([]*pattern, len(list)),
+	}
+	for i, inner := range clauses {
+		p.within[i] = makeListPattern(inner, false, runemap)
 	}
 	var buf bytes.Buffer
 	if fullMatch {
@@ -51,21 +81,34 @@ func makeListPattern(list []*node, fullMatch bool, runemap map[string]rune) *pat
 		} else if c.token.ttype == VAR {
 			buf.WriteString("(.)") // Match a single item
 		} else if c.token.ttype == RVAR {
-			buf.WriteString("(.*)") // Match any number of items
+			// Match a number of items
+			buf.WriteString("(.")
+			buf.WriteString(repeatRegexp(c.token.text))
+			buf.WriteString(")")
+		} else if c.token.ttype == WVAR {
+			// Match a single item and check its text later.
+			buf.WriteString("(.)")
+			p.words[i] = makeWordPattern(c.token.text)
+		} else if hasStringVars(c.token) {
+			// Match a single item and check its contents later.
+			buf.WriteString("(.)")
+			p.words[i] = makeStringPattern(c.token.text)
+		} else if c.token.ttype == ALT {
+			// Match any one of the alternative tokens.
+			_, alts := splitAlt(c.token.text)
+			buf.WriteString("(")
+			for j, a := range alts {
+				if j > 0 {
+					buf.WriteString("|")
+				}
+				buf.WriteRune(p.runeFor(a))
+			}
+			buf.WriteString(")")
 		} else {
 			// Match specific token text by first mapping the
 			// text to a rune and then matching that rune.
-			r, ok := p.runemap[c.token.text]
-			if !ok {
-				// New token; assign it a unique rune.
-				// Adding 128 means we never pick a regexp
-				// special character.
-				r = rune(len(p.runemap) + 128)
-				p.runemap[c.token.text] = r
-			}
-
 			buf.WriteString("(")
-			buf.WriteRune(r)
+			buf.WriteRune(p.runeFor(c.token.text))
 			buf.WriteString(")")
 		}
 	}
@@ -78,6 +121,42 @@ func makeListPattern(list []*node, fullMatch bool, runemap map[string]rune) *pat
 	return p
 }
 
+// repeatRegexp returns the regexp repetition operator for a repeated
+// variable such as $x* or $x{2,3}.
+func repeatRegexp(text string) string {
+	min, max, lazy := repeatBounds(text)
+	var q string
+	switch {
+	case min == 0 && max < 0:
+		q = "*"
+	case min == 1 && max < 0:
+		q = "+"
+	case min == 0 && max == 1:
+		q = "?"
+	case max < 0:
+		q = fmt.Sprintf("{%d,}", min)
+	default:
+		q = fmt.Sprintf("{%d,%d}", min, max)
+	}
+	if lazy {
+		q += "?"
+	}
+	return q
+}
+
+// runeFor returns the rune that represents token text in p.re.
+func (p *pattern) runeFor(text string) rune {
+	r, ok := p.runemap[text]
+	if !ok {
+		// New token; assign it a unique rune.
+		// Adding 128 means we never pick a regexp
+		// special character.
+		r = rune(len(p.runemap) + 128)
+		p.runemap[text] = r
+	}
+	return r
+}
+
 // match represents the result of a successful pattern match.
 // It includes the extent of the matched subject nodes as well as
 // variable assignment.
@@ -86,9 +165,58 @@ type match struct {
 	start, limit int
 }
 
+// text returns the text assigned to the named variable (which is
+// specified without the leading '$' or a repetition suffix), leaving
+// out comments and the spaces around the text.  Comments are left out
+// since copyComments keeps them next to the replacement.
+func (m match) text(name string) string {
+	vals, _ := m.lookup("$" + name)
+	return codeText(vals)
+}
+
+// lookup returns the nodes assigned to the variable named base (e.g.,
+// "$x"), whether the pattern wrote it as $x or with a repetition
+// suffix such as $x*.
+func (m match) lookup(base string) ([]*node, bool) {
+	if vals, ok := m.vars[base]; ok {
+		return vals, true
+	}
+	for k, vals := range m.vars {
+		if baseName(k) == base {
+			return vals, true
+		}
+	}
+	return nil, false
+}
+
+// baseName returns variable name v without any repetition suffix,
+// e.g., "$x" for "$x*" or "$x{2,3}".
+func baseName(v string) string {
+	return v[:1+wordLength([]byte(v[1:]))]
+}
+
+// match returns the first match of p in subject.  If p has a swapped
+// form, the earlier of the matches of p and the swapped form is used.
 func (p *pattern) match(subject []*node) (match, bool) {
-	// Convert subject to a []byte for regexp matching.
-	// Also generate an index that maps from []byte index to subject index.
+	m, ok := p.matchList(subject)
+	if p.swapped != nil {
+		p.swapped.accept = p.accept
+		if sm, sok := p.swapped.matchList(subject); sok && (!ok || sm.start < m.start) {
+			return sm, true
+		}
+	}
+	return m, ok
+}
+
+func (p *pattern) matchList(subject []*node) (match, bool) {
+	sub, byteToSubjectIndex := p.encode(subject)
+	return p.matchEncoded(p.re, subject, sub, byteToSubjectIndex)
+}
+
+// encode converts subject to a []byte for regexp matching.  It also
+// returns an index that maps from []byte index to subject index, with
+// a sentinel entry for the end of the []byte.
+func (p *pattern) encode(subject []*node) ([]byte, []int) {
 	var byteToSubjectIndex []int
 	var buf bytes.Buffer
 	for i, c := range subject {
@@ -110,11 +238,15 @@ func (p *pattern) match(subject []*node) (match, bool) {
 		}
 	}
 	byteToSubjectIndex = append(byteToSubjectIndex, len(subject)) // Sentinel
+	return buf.Bytes(), byteToSubjectIndex
+}
 
-	sub := buf.Bytes()
-
+// matchEncoded returns the first match of re (which is p.re or an
+// anchored form of it) in sub, the encoded form of a suffix of subject.
+// byteToSubjectIndex maps indices in sub to indices in subject.
+func (p *pattern) matchEncoded(re *regexp.Regexp, subject []*node, sub []byte, byteToSubjectIndex []int) (match, bool) {
 outerLoop:
-	for _, m := range p.re.FindAllSubmatchIndex(sub, -1) {
+	for _, m := range re.FindAllSubmatchIndex(sub, -1) {
 		assign := match{
 			vars:  make(map[string][]*node),
 			start: byteToSubjectIndex[m[0]],
@@ -122,9 +254,7 @@ outerLoop:
 		}
 
 		for i, pnode := range p.list {
-			if pnode.children == nil &&
-				pnode.token.ttype != VAR &&
-				pnode.token.ttype != RVAR {
+			if pnode.children == nil && isLiteral(pnode.token) {
 				// Simple token match
 				continue
 			}
@@ -144,9 +274,26 @@ outerLoop:
 				}
 			}
 
+			if w := p.words[i]; w != nil {
+				if !w.match(matched[0], assign.vars) {
+					continue outerLoop
+				}
+				continue
+			}
 			if pnode.children == nil {
 				// Variable assignment
-				assign.vars[pnode.token.text] = matched
+				if name := varName(pnode.token); name != "" {
+					assign.vars[name] = matched
+				}
+				if p.within[i] != nil {
+					cmatch, ok := p.within[i].search(matched)
+					if !ok {
+						continue outerLoop
+					}
+					for k, v := range cmatch.vars {
+						assign.vars[k] = v
+					}
+				}
 				continue
 			}
 
@@ -161,7 +308,305 @@ outerLoop:
 			}
 		}
 
+		if p.accept != nil && !p.accept(assign) {
+			continue
+		}
 		return assign, true
 	}
 	return match{}, false
 }
+
+// reach returns, for each index s in subject, the largest limit of a
+// match of p (or its swapped form) that starts at or before s.  The
+// result is -1 for indices at which no match has started yet.  Each
+// start is tried with an anchored copy of the regular expression
+// against a single encoding of subject, so the cost is close to linear
+// in the length of subject for patterns that start with a token.
+func (p *pattern) reach(subject []*node) []int {
+	result := make([]int, len(subject))
+	for i := range result {
+		result[i] = -1
+	}
+	for q := p; q != nil; q = q.swapped {
+		if q.anchored == nil {
+			q.anchored = regexp.MustCompile("^(?:" + q.re.String() + ")")
+		}
+		sub, index := q.encode(subject)
+		b := 0
+		for s := range subject {
+			for index[b] < s {
+				b++
+			}
+			m, ok := q.matchEncoded(q.anchored, subject, sub[b:], index[b:])
+			if ok && m.limit > result[s] {
+				result[s] = m.limit
+			}
+		}
+	}
+	for s := 1; s < len(result); s++ {
+		if result[s-1] > result[s] {
+			result[s] = result[s-1]
+		}
+	}
+	return result
+}
+
+// commutativeOps lists the binary operators whose operands may be
+// swapped by allowSwap.
+var commutativeOps = []string{"==", "!=", "+", "*", "&", "|", "^", "&&", "||"}
+
+// allowSwap makes p and its sub-patterns also match binary operations
+// whose operator is in ops with the operands in the opposite order.
+// E.g., "$x == NULL" then matches "NULL == ptr" with $x bound to ptr.
+func (p *pattern) allowSwap(ops map[string]bool) {
+	for _, c := range p.childpat {
+		if c != nil {
+			c.allowSwap(ops)
+		}
+	}
+	if len(p.list) != 3 || p.swapped != nil {
+		return
+	}
+	op := p.list[1]
+	if op.children != nil || !isLiteral(op.token) || !ops[op.token.text] {
+		return
+	}
+	for _, w := range p.within {
+		if w != nil {
+			// Clauses are attached by list position.
+			return
+		}
+	}
+	list := []*node{p.list[2], op, p.list[0]}
+	p.swapped = makeListPattern(list, p.full, p.runemap)
+	for _, c := range p.swapped.childpat {
+		if c != nil {
+			c.allowSwap(ops)
+		}
+	}
+}
+
+// search looks for a match of p in list or in the children of any
+// node inside list.
+func (p *pattern) search(list []*node) (match, bool) {
+	if m, ok := p.match(list); ok {
+		return m, true
+	}
+	for _, n := range list {
+		if n.children == nil {
+			continue
+		}
+		if m, ok := p.search(n.children); ok {
+			return m, true
+		}
+	}
+	return match{}, false
+}
+
+// splitContains removes contains clauses from a list of pattern nodes.
+// In "$x contains P", the clause extends from the word contains up to
+// the next comma or semicolon, or up to the closing bracket that ends
+// the list.  The result is the remaining list and a map from the index
+// in the remaining list of each variable with a clause to the nodes of
+// P.
+func splitContains(list []*node) ([]*node, map[int][]*node) {
+	var clauses map[int][]*node
+	var result []*node
+	for i := 0; i < len(list); i++ {
+		result = append(result, list[i])
+		end := clauseEnd(list, i)
+		if end < 0 {
+			continue
+		}
+		if clauses == nil {
+			clauses = make(map[int][]*node)
+		}
+		clauses[len(result)-1] = list[i+2 : end]
+		i = end - 1
+	}
+	if clauses == nil {
+		return list, nil
+	}
+	return result, clauses
+}
+
+// clauseEnd returns the index just past the contains clause that
+// follows the variable at list[i], or -1 if there is no such clause.
+func clauseEnd(list []*node, i int) int {
+	v := list[i]
+	if v.children != nil || (v.token.ttype != VAR && v.token.ttype != RVAR) {
+		return -1
+	}
+	if i+2 >= len(list) {
+		return -1
+	}
+	if w := list[i+1]; w.children != nil || w.token.ttype != WORD || w.token.text != "contains" {
+		return -1
+	}
+	end := i + 2
+	for end < len(list) {
+		n := list[end]
+		if n.children == nil &&
+			(n.token.text == "," || n.token.text == ";" ||
+				(n.token.ttype == CLOSER && end == len(list)-1)) {
+			break
+		}
+		end++
+	}
+	if end == i+2 {
+		return -1 // Empty clause
+	}
+	return end
+}
+
+// clauseNodes returns the set of nodes in pattern tree n that belong
+// to contains clauses (including the word contains).  Since such nodes
+// may occur at any depth in the subject, they cannot be used as
+// anchors.
+func clauseNodes(n *node) map[*node]bool {
+	result := make(map[*node]bool)
+	perNode(n, func(c *node) {
+		for i := range c.children {
+			end := clauseEnd(c.children, i)
+			if end < 0 {
+				continue
+			}
+			for _, d := range c.children[i+1 : end] {
+				perNode(d, func(x *node) { result[x] = true })
+			}
+		}
+	})
+	return result
+}
+
+// isLiteral returns true iff pattern token t has to be matched by a
+// subject token with the same text.
+func isLiteral(t token) bool {
+	switch t.ttype {
+	case VAR, RVAR, EXPR, WVAR, ALT:
+		return false
+	}
+	return !hasStringVars(t)
+}
+
+// varName returns the name of the variable bound by pattern token t, or
+// the empty string if t does not bind a variable.
+func varName(t token) string {
+	name := ""
+	switch t.ttype {
+	case VAR, RVAR:
+		name = t.text
+	case ALT:
+		name, _ = splitAlt(t.text)
+	}
+	if isAnonymous(name) {
+		return ""
+	}
+	return name
+}
+
+// isAnonymous returns true iff name is an anonymous wildcard such as
+// $_ or $_*, which matches like any other variable but is never bound.
+func isAnonymous(name string) bool {
+	return name != "" && baseName(name) == "$_"
+}
+
+// wordPattern matches a subject word against a WVAR token such as
+// get_$field and binds the variable parts of the word.
+type wordPattern struct {
+	re    *regexp.Regexp
+	names []string // Variable bound by each sub-match of re
+
+	// For string patterns, the delimiter of the string; zero for words.
+	delimiter byte
+}
+
+func makeWordPattern(text string) *wordPattern {
+	w := &wordPattern{}
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	for _, piece := range splitWord(text) {
+		if piece[0] != '$' {
+			buf.WriteString(regexp.QuoteMeta(piece))
+			continue
+		}
+		w.names = append(w.names, wordVarName(piece))
+		buf.WriteString("([A-Za-z0-9_]+)")
+	}
+	buf.WriteString("$")
+	w.re = regexp.MustCompile(buf.String())
+	return w
+}
+
+// makeStringPattern returns a pattern that matches the unescaped body
+// of a string literal against a pattern string such as "$prefix%lu",
+// whose variables match any text.
+func makeStringPattern(text string) *wordPattern {
+	w := &wordPattern{delimiter: text[0]}
+	var buf bytes.Buffer
+	buf.WriteString("(?s)^")
+	pieces, isVar := splitString(text)
+	for i, piece := range pieces {
+		if !isVar[i] {
+			buf.WriteString(regexp.QuoteMeta(unquoteString(quoteDelimited(piece, w.delimiter))))
+			continue
+		}
+		w.names = append(w.names, wordVarName(piece))
+		buf.WriteString("(.*?)")
+	}
+	buf.WriteString("$")
+	w.re = regexp.MustCompile(buf.String())
+	return w
+}
+
+// quoteDelimited returns body surrounded by delimiter.
+func quoteDelimited(body string, delimiter byte) string {
+	return string(delimiter) + body + string(delimiter)
+}
+
+// wordVarName returns the variable named by a $name or ${name} piece
+// of a WVAR token.
+func wordVarName(piece string) string {
+	if strings.HasPrefix(piece, "${") {
+		return "$" + strings.TrimSpace(strings.TrimSuffix(piece[2:], "}"))
+	}
+	return piece
+}
+
+// match returns true iff subject node n is a word that matches w.  If so,
+// each variable in w is bound in vars to a word node holding the
+// corresponding part of n.  For string patterns, n must be a string
+// literal with the same delimiter whose unescaped body matches, and the
+// variables are bound to the unescaped parts.
+func (w *wordPattern) match(n *node, vars map[string][]*node) bool {
+	if n.children != nil {
+		return false
+	}
+	text := n.token.text
+	if w.delimiter != 0 {
+		if n.token.ttype != STRING || len(text) < 2 || text[0] != w.delimiter || text[len(text)-1] != w.delimiter {
+			return false
+		}
+		text = unquoteString(text)
+	} else if n.token.ttype != WORD {
+		return false
+	}
+	m := w.re.FindStringSubmatchIndex(text)
+	if m == nil {
+		return false
+	}
+	for i, name := range w.names {
+		if isAnonymous(name) {
+			continue
+		}
+		start, limit := m[2*(i+1)], m[2*(i+1)+1]
+		part := token{
+			ttype:  WORD,
+			line:   n.token.line,
+			column: n.token.column + start,
+			text:   text[start:limit],
+		}
+		vars[name] = []*node{&node{token: part}}
+	}
+	return true
+}
@@ -43,6 +43,36 @@ func TestMatch(t *testing.T) {
 		tcase("x 1 y 2 3 z 4 5", "x $a y $b* z $c*", 0, 8,
 			"$a => 1 ", "$b* => 2 3 ", "$c* => 4 5"),
 
+		// Bounded and lazy repetition
+		tcase("x y", "x $a+ y", -1, -1),
+		tcase("x 1 y", "x $a+ y", 0, 3, "$a+ => 1 "),
+		tcase("x y", "x $a? y", 0, 2, "$a? => "),
+		tcase("x 1 2 y", "x $a? y", -1, -1),
+		tcase("x 1 2 y", "x $a{2} y", 0, 4, "$a{2} => 1 2 "),
+		tcase("x 1 2 3 y", "x $a{1,2} y", -1, -1),
+		tcase("x 1 y 2 y", "x $a* y", 0, 5, "$a* => 1 y 2 "),
+		tcase("x 1 y 2 y", "x $a*? y", 0, 3, "$a*? => 1 "),
+		tcase("x 1 2 3", "x $a{1,}? $b*", 0, 4, "$a{1,}? => 1 ", "$b* => 2 3"),
+
+		// A repeated variable after a comma needs the comma.
+		tcase("f(a)", "f($first, $rest*)", -1, -1),
+		tcase("f(a, b, c)", "f($first, $rest*)", 0, 8, "$first => a", "$rest* => b, c"),
+		tcase("f(a)", "f($first $rest*)", 0, 4, "$first => a", "$rest* => "),
+
+		// Anonymous variables
+		tcase("memset(p, 0, sizeof(*p))", "memset($_, 0, sizeof($_))", 0, 8),
+		tcase("f(a, b, c)", "f($_*, $x)", 0, 8, "$x => c"),
+		tcase("get_x y", "get_$_ $y", 0, 2, "$y => y"),
+		tcase("a = b", "$_:[a|b] $_ $v:[a|b]", 0, 3, "$v => b"),
+
+		// Contains clauses
+		tcase("free(p->q)", "free($p contains $a->$b)", 0, 4, "$a => p", "$b => q", "$p => p->q"),
+		tcase("free(f(p->q))", "free($p contains $_->$_)", 0, 4, "$p => f(p->q)"),
+		tcase("free(p)", "free($p contains $_->$_)", -1, -1),
+		tcase("f(a, g(b))", "f($x contains b, $y contains b)", -1, -1),
+		tcase("f(b, g(b))", "f($x contains b, $y contains b)", 0, 6, "$x => b", "$y => g(b)"),
+		tcase("if (a && errno == 0) {}", "if ($c contains errno) {$b*}", 0, 3, "$b* => ", "$c => a && errno == 0"),
+
 		// Subtree failure
 		tcase("x(y,z)", "x($a,w)", -1, -1),
 
@@ -51,6 +81,26 @@ func TestMatch(t *testing.T) {
 
 		// Deep subtree
 		tcase("x(y(z))", "x($a)", 0, 4, "$a => y(z)"),
+
+		// Alternation
+		tcase("calloc(n)", "$[malloc|calloc]($a)", 0, 4, "$a => n"),
+		tcase("calloc(n)", "$f:[malloc|calloc]($a)", 0, 4, "$a => n", "$f => calloc"),
+		tcase("free(n)", "$[malloc|calloc]($a)", -1, -1),
+		tcase("a += b", "a $[=|+=|-=] b", 0, 3),
+
+		// Variables inside words
+		tcase("get_x(1)", "get_$f($a*)", 0, 4, "$a* => 1", "$f => x"),
+		tcase("x get_foo_bar y", "get_$f", 1, 2, "$f => foo_bar"),
+		tcase("x get_ y", "get_$f", -1, -1),
+		tcase("set_a_get", "${a}_$b", 0, 1, "$a => set_a", "$b => get"),
+		tcase("old_x_v1 new_y_v2", "new_${a}_v2", 1, 2, "$a => y"),
+		tcase("\"get_x\"", "get_$f", -1, -1),
+
+		// Patterns inside string literals
+		tcase(`f("%lu items\n")`, `"$pre%lu$post"`, 2, 3, "$post =>  items\n", "$pre => "),
+		tcase(`x = "a.b.c"`, `"$a.$b"`, 2, 3, "$a => a", "$b => b.c"),
+		tcase(`x = 'a.b'`, `"$a.$b"`, -1, -1),
+		tcase(`x = "cost: $5"`, `"cost: $$$n"`, 2, 3, "$n => 5"),
 	} {
 		//fmt.Fprintln(os.Stderr, "X", c.subject, c.pattern)
 		expect := strings.Join(c.assign, "\n")
@@ -59,7 +109,7 @@ func TestMatch(t *testing.T) {
 		if len(s.children) == 0 {
 			s = &node{children: []*node{s}}
 		}
-		p := parse([]byte(c.pattern))
+		p := parsePattern([]byte(c.pattern), "")
 		if len(p.children) == 0 {
 			p = &node{children: []*node{p}}
 		}
@@ -1,15 +1,39 @@
 package main
 
-import "sort"
+import (
+	"sort"
+	"strings"
+)
 
 type replacer struct {
 	freq  map[string]int // Frequency of each token text.
 	occur map[string][]*node
 }
 
-func replace(subject, pattern, replacement *node) {
-	// TODO: Verify that pattern does not have same var multiple times.
-	r := &replacer{
+// replace replaces every match of r's pattern in subject with r's
+// replacement and returns the number of replacements made.
+func replace(subject *node, r *rule) int {
+	pattern, replacement := r.pattern, r.replacement
+	if c, ok := commentRule(pattern); ok {
+		return replaceComments(subject, r, c)
+	}
+	// Context information is cached per subject; see encloses.
+	r.reach = nil
+
+	chainOps := make(map[*node]string) // Operator of each flattened chain
+	if len(r.associative) > 0 {
+		// Match against flat chains and nest them again afterwards.
+		pattern = clone(pattern)
+		flattenChains(pattern, r.associative)
+		fixFields(pattern, nil, 0)
+		chains := flattenChains(subject, r.associative)
+		fixFields(subject, subject.parent, subject.depth)
+		defer nestChains(chains)
+		for _, c := range chains {
+			chainOps[c] = chainOp(c)
+		}
+	}
+	rep := &replacer{
 		freq:  make(map[string]int),
 		occur: make(map[string][]*node),
 	}
@@ -18,75 +42,113 @@ func replace(subject, pattern, replacement *node) {
 	// to nodes.
 	perNode(subject, func(n *node) {
 		if n.children == nil {
-			r.freq[n.token.text]++
-			r.occur[n.token.text] = append(r.occur[n.token.text], n)
+			rep.freq[n.token.text]++
+			rep.occur[n.token.text] = append(rep.occur[n.token.text], n)
 		}
 	})
 
 	// Pick least frequent anchor point in pattern
 	var anchor *node
 	anchorCount := 1000000000
+	clauses := clauseNodes(pattern)
 	perNode(pattern, func(n *node) {
-		if n.children != nil {
+		if n.children != nil || clauses[n] {
 			return
 		}
-		if n.token.ttype == VAR || n.token.ttype == RVAR {
+		if !isLiteral(n.token) {
 			return
 		}
-		c := r.freq[n.token.text]
+		c := rep.freq[n.token.text]
 		if c < anchorCount {
 			anchor = n
 			anchorCount = c
 		}
 	})
-	if anchor == nil {
-		// TODO: Either handle patterns with no anchors, or raise error.
-		return
-	}
 
-	// Order anchor occurences in subject in decreasing depth.
-	occ, ok := r.occur[anchor.token.text]
-	if !ok {
-		return
+	// Find the lists in which pattern might match, deepest first.
+	var lists []*node
+	if anchor != nil {
+		// Order anchor occurences in subject in decreasing depth.
+		occ := rep.occur[anchor.token.text]
+		sort.Slice(occ, func(i, j int) bool {
+			return occ[i].depth > occ[j].depth
+		})
+		for _, sub := range occ {
+			// anchor might be deep inside the pattern.  Pop back
+			// up until we are at root.
+			if sub.depth < anchor.depth {
+				continue // Cannot match here
+			}
+			for i := 0; i < anchor.depth; i++ {
+				sub = sub.parent
+			}
+			lists = append(lists, sub)
+		}
+	} else {
+		// Every leaf in pattern is a variable, so there is no anchor.
+		// Fall back to a structural scan over every list in subject.
+		perNode(subject, func(n *node) {
+			if n.children != nil {
+				lists = append(lists, n)
+			}
+		})
+		sort.SliceStable(lists, func(i, j int) bool {
+			return lists[i].depth > lists[j].depth
+		})
 	}
-	sort.Slice(occ, func(i, j int) bool {
-		return occ[i].depth > occ[j].depth
-	})
 
 	pat := makePattern(pattern)
+	multiLine := !r.keepIndent && spansLines(replacement)
+	if len(r.commutative) > 0 {
+		pat.allowSwap(r.commutative)
+	}
 
-	var last *node
-	for _, sub := range occ {
-		// anchor might be deep inside the pattern.  Pop back
-		// up until we are at root.
-		if sub.depth < anchor.depth {
-			continue // Cannot match here
-		}
-		for i := 0; i < anchor.depth; i++ {
-			sub = sub.parent
-		}
-		// Skip if we are in same list as last iteration.
-		if sub == last {
+	count := 0
+	seen := make(map[*node]bool)
+	for _, sub := range lists {
+		// Skip lists we have already processed.
+		if seen[sub] {
 			continue
 		}
-		last = sub
+		seen[sub] = true
 
 		start := 0
 		for start < len(sub.children) {
 			// Look for next match of pat in slist
 			src := sub.children
+			offset := start
+			pat.accept = func(m match) bool {
+				return r.inLines(src[offset+m.start:offset+m.limit]) &&
+					r.matchComments(src[offset+m.start:offset+m.limit], m) &&
+					r.accept(m) && r.inContext(sub, offset+m.start, offset+m.limit)
+			}
 			m, ok := pat.match(src[start:])
 			if !ok {
 				break
 			}
+			if m.start == m.limit {
+				// Nothing to replace in an empty match.
+				start += m.start + 1
+				continue
+			}
 
-			// Generate replacement nodes.
-			result := substitute(replacement, m)
+			// Generate replacement nodes, indenting each line of a
+			// multi-line replacement to fit the line where the
+			// match starts.
+			rep := replacement
+			if multiLine {
+				rep = reindent(replacement, lineIndent(leaves(src[start+m.start])[0]))
+			}
+			result := substitute(rep, m)
+			result = copyComments(src[start+m.start:start+m.limit], result)
 			for _, r := range result {
 				r.parent = sub
 				r.depth = sub.depth + 1
+				r.replaced = true
+			}
+			if op, ok := chainOps[sub]; ok {
+				result = groupOperand(result, op)
 			}
-			result = copyComments(src[start+m.start:start+m.limit], result)
 
 			// Children are ordered as follows:
 			//   first start		Not passed to Match
@@ -100,11 +162,15 @@ func replace(subject, pattern, replacement *node) {
 			dst = append(dst, src[len(src)-remainder:]...)
 			sub.children = dst
 			fixFields(sub, sub.parent, sub.depth)
+			r.changed(sub)
+
+			count++
 
 			// Continue matching just past replaced nodes.
 			start = start + m.start + len(result)
 		}
 	}
+	return count
 }
 
 func substitute(replacement *node, m match) []*node {
@@ -117,25 +183,204 @@ func substitute(replacement *node, m match) []*node {
 	}
 
 	tok := replacement.token
+	if tok.ttype == EXPR {
+		e, err := parseExpr(tok.text)
+		if err != nil {
+			// validate() reports bad expressions up front.
+			panic(err)
+		}
+		r := cloneLeaf(replacement, m)
+		r.token.text = e.eval(m.text)
+		r.token.ttype = WORD
+		if e.call && e.name == "quote" {
+			r.token.ttype = STRING
+		}
+		return append(res, r)
+	}
+	if tok.ttype == WVAR {
+		r := cloneLeaf(replacement, m)
+		r.token.text = ""
+		for _, piece := range splitWord(tok.text) {
+			if piece[0] == '$' {
+				piece = m.refText(piece)
+			}
+			r.token.text += piece
+		}
+		r.token.ttype = WORD
+		return append(res, r)
+	}
+	if hasStringVars(tok) {
+		// Substitute into the string body, escaping the
+		// substituted text for the delimiter.
+		r := cloneLeaf(replacement, m)
+		delim := tok.text[0]
+		body := ""
+		pieces, isVar := splitString(tok.text)
+		for i, piece := range pieces {
+			if isVar[i] {
+				q := quoteString(m.refText(piece), delim)
+				piece = q[1 : len(q)-1]
+			}
+			body += piece
+		}
+		r.token.text = quoteDelimited(body, delim)
+		return append(res, r)
+	}
 	if tok.ttype != VAR && tok.ttype != RVAR {
-		return append(res, clone(replacement))
+		return append(res, cloneLeaf(replacement, m))
 	}
 
 	vals, ok := m.vars[tok.text]
 	if !ok {
-		// TODO: Check for this and raise error earlier
-		panic("variable not found + " + tok.text)
+		name, rest, _ := splitVarRef(tok.text, func(v string) bool {
+			_, ok := m.lookup(v)
+			return ok
+		})
+		if rest != "" {
+			// The name runs into literal text, as in
+			// $field_getter.
+			r := cloneLeaf(replacement, m)
+			r.token.text = m.refText(tok.text)
+			r.token.ttype = WORD
+			return append(res, r)
+		}
+		// A repeated variable used without its suffix, as in $x
+		// for $x*, stands for the captured nodes too.
+		vals, _ = m.lookup(name)
 	}
 	for _, v := range vals {
 		res = append(res, clone(v))
 	}
+	if len(res) > 0 && startsLine(tok) {
+		// Keep the line break (and indentation) that precedes
+		// the variable in the replacement.
+		first := leaves(res[0])[0]
+		prefix := append([]token(nil), tok.prefix...)
+		for _, t := range first.token.prefix {
+			if t.ttype != SPACE {
+				prefix = append(prefix, t)
+			}
+		}
+		first.token.prefix = prefix
+	}
+	if len(res) > 0 && len(tok.suffix) > 0 {
+		// Keep the space that follows the variable in the
+		// replacement unless the value brings its own.
+		last := leaves(res[len(res)-1])
+		if l := last[len(last)-1]; len(l.token.suffix) == 0 {
+			l.token.suffix = append([]token(nil), tok.suffix...)
+		}
+	}
 	return res
 }
 
+// startsLine returns true iff t is preceded by a line break.
+func startsLine(t token) bool {
+	for _, x := range t.prefix {
+		if x.ttype == SPACE && strings.Contains(x.text, "\n") {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneLeaf returns a copy of replacement leaf n.  Variables bound by
+// m are substituted in the text of attached comments; references to
+// variables that are not bound are kept as is.
+func cloneLeaf(n *node, m match) *node {
+	r := clone(n)
+	r.replaced = true
+	r.token.prefix = fillComments(r.token.prefix, m)
+	r.token.suffix = fillComments(r.token.suffix, m)
+	return r
+}
+
+// fillComments returns a copy of trivia in which variables bound by m
+// are substituted in comments and $$ stands for a literal $.
+func fillComments(trivia []token, m match) []token {
+	var result []token
+	for _, t := range trivia {
+		if t.ttype == COMMENT {
+			text := ""
+			pieces, isVar := splitText(t.text)
+			for i, piece := range pieces {
+				if isVar[i] && m.binds(piece) {
+					piece = m.refText(piece)
+				}
+				text += piece
+			}
+			t.text = text
+		}
+		result = append(result, t)
+	}
+	return result
+}
+
+// binds returns true iff every variable in reference ref ($name or
+// ${...}) is bound by m.
+func (m match) binds(ref string) bool {
+	if !strings.HasPrefix(ref, "${") {
+		_, ok := m.lookup(ref)
+		return ok
+	}
+	e, err := parseExpr(ref)
+	if err != nil || e.check() != nil {
+		return false
+	}
+	ok := true
+	e.vars(func(name string) {
+		if _, found := m.lookup("$" + name); !found {
+			ok = false
+		}
+	})
+	return ok
+}
+
+// refText returns the text for a variable reference ($name or ${...})
+// in the replacement.  If $name is not bound, the longest bound
+// variable that is a prefix of $name is used, followed by the rest of
+// the name.  E.g., if $field is bound to "x", $field_getter yields
+// "x_getter".
+func (m match) refText(ref string) string {
+	if strings.HasPrefix(ref, "${") {
+		e, err := parseExpr(ref)
+		if err != nil {
+			// validate() reports bad expressions up front.
+			panic(err)
+		}
+		return e.eval(m.text)
+	}
+	name, rest, ok := splitVarRef(ref, func(v string) bool {
+		_, ok := m.lookup(v)
+		return ok
+	})
+	if !ok {
+		// validate() reports unbound variables up front.
+		panic("variable not found + " + ref)
+	}
+	return m.text(name[1:]) + rest
+}
+
+// splitVarRef splits ref into the longest bound variable name that is
+// a prefix of ref and the remaining text.  isBound reports whether a
+// variable such as "$x" is bound (perhaps with a repetition suffix).
+func splitVarRef(ref string, isBound func(string) bool) (string, string, bool) {
+	for i := len(ref); i > 1; i-- {
+		if isBound(ref[:i]) {
+			return ref[:i], ref[i:], true
+		}
+	}
+	return "", "", false
+}
+
 func clone(n *node) *node {
 	r := &node{}
 	*r = *n
-	for i, c := range r.children {
+	if n.children != nil {
+		// Do not share the children array with n.
+		r.children = make([]*node, len(n.children))
+	}
+	for i, c := range n.children {
 		r.children[i] = clone(c)
 	}
 	return r
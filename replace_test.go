@@ -37,11 +37,71 @@ func TestReplace(t *testing.T) {
 		// Overlapping match; should only replace once.
 		{"x#y#z", "$a#$b", "$b#$a", "y#x#z"},
 
+		// Patterns without literal anchors.
+		{"a b", "$x $y", "$y $x", "b a "},
+		{"f(g(a))", "$x($y)", "$y", "a"},
+		{"(a, b) + (c)", "($x*)", "[$x*]", "[a, b] + [c]"},
+
+		// Transformations of captured text.
+		{"f(foo_bar)", "f($x)", "Get${camel(x)}()", "GetFooBar()"},
+		{"f(fooBar)", "f($x)", "${snake(x)}_v2", "foo_bar_v2"},
+		{"f(old_name)", "f($x)", `${upper(trimprefix(x, "old_"))}`, "NAME"},
+		{"f(a /*c*/ + b)", "f($x*)", "g(${quote(x)})", `g("a + b")/*c*/`},
+		{"f(a/*c*/+b)", "f($x*)", "g(${quote(x)})", `g("a+b")/*c*/`},
+		{"f(a, // c\n  b)", "f($x*)", `g("$x")`, "g(\"a, b\")// c\n"},
+		{"f(x)", "f($x)", "  ${upper(x)} ", "  X "},
+
+		// A repeated variable used without its suffix.
+		{"f(a /*c*/ + b)", "f($x*)", "g($x)", "g(a /*c*/ + b)"},
+		{"f(1, 2)", "f($x+)", "g($x)", "g(1, 2)"},
+
+		// Variables inside words.
+		{"get_foo(1)", "get_$f($a*)", "$f_getter($a*)", "foo_getter(1)"},
+		{"get_foo(1)", "get_$f($a*)", "${f}_getter($a*)", "foo_getter(1)"},
+		{"get_foo_bar()", "get_$f()", "Get${camel(f)}()", "GetFooBar()"},
+		{"x = get_a + set_b", "get_$f", "my_$f", "x = my_a + set_b"},
+
+		// Strings with variables.
+		{`printf("%lu items\n", n)`, `printf("$a%lu$b", $x*)`, `printf("${a}%" PRIu64 "$b", $x*)`, `printf("%" PRIu64 " items\n", n)`},
+		{`get("config.old_key")`, `"config.$k"`, `"settings.${upper(k)}"`, `get("settings.OLD_KEY")`},
+		{`f('a', "it's")`, `f('$c', "$s")`, `g("$c", '$s')`, `g("a", 'it\'s')`},
+		{`log(name)`, `log($x)`, `log("name=\"$x\"")`, `log("name=\"name\"")`},
+		{`f("a\x41b\a\d")`, `f("$x")`, `f('$x')`, `f('a\x41b\007\d')`},
+
+		// Alternation.
+		{"malloc(1); calloc(2); free(3)", "$f:[malloc|calloc]($a)", "my_$f($a)", "my_malloc(1); my_calloc(2); free(3)"},
+		{"realloc(p, 1)", "$[malloc|realloc]($a*)", "xalloc($a*)", "xalloc(p, 1)"},
+
+		// Bounded and lazy repetition.
+		{"f(a) f() f(a, b)", "f($a+)", "g($a+)", "g(a) f() g(a, b)"},
+		{"f(1, 2, 3)", "f($a*?, $b*)", "g($b*; ${a})", "g(2, 3; 1)"},
+
+		// Anonymous variables.
+		{"memset(p, 0, sizeof(*p))", "memset($_, 0, sizeof($_))", "bzero()", "bzero()"},
+
+		// Contains clauses.
+		{"free(p->buf); free(q);", "free($p contains $_->$_)", "xfree($p)", "xfree(p->buf); free(q);"},
+		{"f(g(errno)); f(h);", "f($x contains errno)", "f_errno($x)", "f_errno(g(errno)); f(h);"},
+
 		// Comment copying.
 		{"x/*foo*/+0", "$a+0", "$a", "x/*foo*/"},
 		{"x+0/*foo*/", "$a+0", "$a", "x/*foo*/"},
 		{"/*foo*/0+x", "0+$a", "$a", "/*foo*/x"},
 
+		// Comments in the middle stay with their tokens.
+		{"f(1 /*one*/, 2 /*two*/)", "f(1, 2)", "g(2, 1)", "g(2 /*two*/, 1 /*one*/)"},
+		{"foo(p, /*flags*/ 0, n)", "foo($p, 0, $n)", "bar($n, 0, $p)", "bar(n, /*flags*/ 0, p)"},
+		{"f(a /*A*/, b /*B*/)", "f($a, $b)", "f($b, $a)", "f(b /*B*/, a /*A*/)"},
+		{"f(a, /*A*/ b, /*B*/ c)", "f($a, $b, $c)", "f($c, $b, $a)", "f(c, /*A*/ b, /*B*/ a)"},
+		{"f(1 /*one*/, 1 /*two*/)", "f(1, 1)", "g(1, 1)", "g(1 /*one*/, 1 /*two*/)"},
+		{"f(1,\n  // two\n  2)", "f(1, 2)", "g(2)", "g(// two\n  2)"},
+		{"a + /*c*/ 0", "$a + 0", "$a", "a /*c*/"},
+
+		// Pattern syntax in the input is ordinary text.
+		{"`id=${userId}`; f(userId);", "userId", "uid", "`id=${uid}`; f(uid);"},
+		{"echo ${HOME} $HOME", "$${HOME}", "$${USER}", "echo ${USER} $HOME"},
+		{"x = $a+ 1;", "$$a+ 1", "1 + $$a", "x = 1 + $a;"},
+
 		// Newlines must be preserved on either side.
 		{"\nx", "x", "y", "\ny"},
 		{"\nx+0", "$a+0", "$a", "\nx"},
@@ -50,9 +110,9 @@ func TestReplace(t *testing.T) {
 		{"\n\n\nx y\n\n", "x y", "z", "\n\n\nz\n\n"},
 	} {
 		sub := parse([]byte(c.subject))
-		pat := parse([]byte(c.pattern))
-		rep := parse([]byte(c.replacement))
-		replace(sub, pat, rep)
+		pat := parsePattern([]byte(c.pattern), "")
+		rep := parsePattern([]byte(c.replacement), "")
+		replace(sub, &rule{pattern: pat, replacement: rep})
 		out := string(sub.serialize())
 		//fmt.Println("Result:", out)
 		if out != c.output {
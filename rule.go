@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// rule holds a pattern and replacement along with settings that
+// restrict which matches are replaced.
+type rule struct {
+	pattern, replacement *node
+
+	// Conditions that every match must satisfy.
+	where []*condition
+
+	// Every match must be enclosed by a match of each inside pattern
+	// and by no match of any notInside pattern.
+	inside, notInside []*pattern
+
+	// Operators whose operands may appear in either order.
+	commutative map[string]bool
+
+	// Operators whose chains are matched as flat lists.
+	associative map[string]bool
+
+	// If true, multi-line replacements are inserted as written instead
+	// of being indented to fit the line where the match starts.
+	keepIndent bool
+
+	// Comments that must be attached to the matched code.
+	comments []*commentPattern
+
+	// Text that starts a variable in the pattern, replacement and
+	// directives, if not "$".
+	sigil string
+
+	// Line edits made to each file in which a replacement is made.
+	fileEdits []*fileEdit
+
+	// If non-nil, every match must overlap one of these lines of the
+	// input.  An empty list allows no matches.
+	lines []lineRange
+
+	// Cached reach of each inside and notInside pattern per subject
+	// list; see encloses.
+	reach map[*pattern]map[*node][]int
+}
+
+// condition is a test applied to the variables bound by a match, e.g.,
+// "$s not matches $_ + $_" or "$s !~ /^"/".
+type condition struct {
+	line   int    // Line number in rule file
+	name   string // Variable being tested
+	op     string // One of contains, matches, equals, =~
+	negate bool
+
+	other string         // Second variable for equals
+	pat   *pattern       // Pattern for contains and matches
+	re    *regexp.Regexp // Regular expression for =~
+}
+
+// ruleSeparator separates sections of a rule file.
+var ruleSeparator = regexp.MustCompile("(?m)^---+\n")
+
+// readRule reads a rule from the named file.  The file holds the
+// pattern, followed by the replacement, followed by an optional list of
+// directives, one per line, with the three parts separated by lines
+// that consist entirely of dashes (at least three dashes are required).
+//
+// Each directive starts with a keyword:
+//
+//	where $var [not] contains _pattern_
+//	where $var [not] matches _pattern_
+//	where $var [not] equals $other
+//	where $var =~ /_regexp_/
+//	where $var !~ /_regexp_/
+//	inside: _pattern_
+//	not-inside: _pattern_
+//	commutative [_operators_]
+//	associative [_operators_]
+//	comment: _comment_
+//	ensure-line: _line_
+//	remove-line: _line_ [unless-used _words_]
+//	sigil: _text_
+//
+// Empty lines and lines starting with # are ignored.
+func readRule(fname string) (*rule, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	r, err := parseRule(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", fname, err)
+	}
+	return r, nil
+}
+
+// parseRule parses the contents of a rule file.  Error messages start
+// with the line number at which the error was found.
+func parseRule(data []byte) (*rule, error) {
+	seps := ruleSeparator.FindAllIndex(data, 2)
+	if len(seps) == 0 {
+		return nil, errors.New("1: no separator line")
+	}
+	section := func(start, limit int) []byte {
+		// The newline that ends the last line of a section is not
+		// part of the pattern or replacement.
+		s := data[start:limit]
+		s = bytes.TrimSuffix(s, []byte("\n"))
+		return bytes.TrimSuffix(s, []byte("\r"))
+	}
+	r := &rule{}
+	if len(seps) == 1 {
+		r.pattern = parsePattern(section(0, seps[0][0]), "")
+		r.replacement = parsePattern(section(seps[0][1], len(data)), "")
+		return r, nil
+	}
+
+	// The sigil affects how everything else is parsed, so find it
+	// before parsing the rest of the file.
+	first := 1 + strings.Count(string(data[:seps[1][1]]), "\n")
+	lines := strings.Split(string(data[seps[1][1]:]), "\n")
+	for i, line := range lines {
+		if keyword, rest := splitFirst(line); strings.TrimSuffix(keyword, ":") == "sigil" {
+			if err := r.setSigil(rest); err != nil {
+				return nil, fmt.Errorf("%d: %v", first+i, err)
+			}
+		}
+	}
+	r.pattern = parsePattern(section(0, seps[0][0]), r.sigil)
+	r.replacement = parsePattern(section(seps[0][1], seps[1][0]), r.sigil)
+	for i, line := range lines {
+		if err := r.addDirective(first+i, line); err != nil {
+			return nil, fmt.Errorf("%d: %v", first+i, err)
+		}
+	}
+	return r, nil
+}
+
+// addDirective adds the setting described by one directive line.
+func (r *rule) addDirective(lineno int, line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+	keyword, rest := splitFirst(line)
+	switch strings.TrimSuffix(keyword, ":") {
+	case "where":
+		c, err := parseCondition(rest, r.sigil)
+		if err != nil {
+			return err
+		}
+		c.line = lineno
+		r.where = append(r.where, c)
+	case "inside", "not-inside":
+		if rest == "" {
+			return fmt.Errorf("missing pattern after %s", keyword)
+		}
+		n := parsePattern([]byte(rest), r.sigil)
+		if errs := checkBrackets("pattern", n); len(errs) > 0 {
+			return errors.New(errs[0])
+		}
+		if keyword[0] == 'i' {
+			r.inside = append(r.inside, makeContextPattern(n))
+		} else {
+			r.notInside = append(r.notInside, makeContextPattern(n))
+		}
+	case "comment":
+		c, ok := commentRule(parsePattern([]byte(rest), r.sigil))
+		if !ok {
+			return fmt.Errorf("%s must be followed by a single comment", keyword)
+		}
+		r.comments = append(r.comments, makeCommentPattern(c.text))
+	case "sigil":
+		// Handled by parseRule before anything else is parsed.
+	case "commutative":
+		return r.addCommutative(rest)
+	case "associative":
+		return r.addAssociative(rest)
+	case "ensure-line", "remove-line":
+		e, err := parseFileEdit(keyword[0] == 'r', rest)
+		if err != nil {
+			return err
+		}
+		r.fileEdits = append(r.fileEdits, e)
+	default:
+		return fmt.Errorf("unknown directive %q", keyword)
+	}
+	return nil
+}
+
+// setSigil makes variables start with sigil instead of $.
+func (r *rule) setSigil(sigil string) error {
+	if sigil == "" {
+		return errors.New("missing sigil")
+	}
+	for i := 0; i < len(sigil); i++ {
+		if c := sigil[i]; isWordByte(c) || isSpace(c) || c == '$' || c == '\\' {
+			return fmt.Errorf("sigil %q must not contain letters, digits, _, spaces, $ or \\", sigil)
+		}
+	}
+	if r.sigil != "" && r.sigil != sigil {
+		return fmt.Errorf("sigil %q conflicts with earlier sigil %q", sigil, r.sigil)
+	}
+	r.sigil = sigil
+	return nil
+}
+
+// addCommutative marks the listed operators as commutative.  See
+// addOperators for the syntax of list.
+func (r *rule) addCommutative(list string) error {
+	return addOperators(&r.commutative, "commutative", list, commutativeOps)
+}
+
+// addAssociative marks the listed operators as associative.  See
+// addOperators for the syntax of list.
+func (r *rule) addAssociative(list string) error {
+	return addOperators(&r.associative, "associative", list, associativeOps)
+}
+
+// addOperators adds the operators in list to *set.  The operators are
+// separated by spaces or commas; an empty list or "all" selects every
+// operator in allowed.  The operators are described as what in error
+// messages.
+func addOperators(set *map[string]bool, what, list string, allowed []string) error {
+	ops := strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	if len(ops) == 0 || (len(ops) == 1 && ops[0] == "all") {
+		ops = allowed
+	}
+	if *set == nil {
+		*set = make(map[string]bool)
+	}
+	for _, op := range ops {
+		found := false
+		for _, a := range allowed {
+			found = found || a == op
+		}
+		if !found {
+			return fmt.Errorf("%q is not %s %s operator (expecting one of %s)", op, article(what), what, strings.Join(allowed, " "))
+		}
+		(*set)[op] = true
+	}
+	return nil
+}
+
+// article returns the indefinite article for word.
+func article(word string) string {
+	if strings.ContainsRune("aeiou", rune(word[0])) {
+		return "an"
+	}
+	return "a"
+}
+
+// splitFirst splits s into its first space-separated field and the
+// remaining text.
+func splitFirst(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return r < 128 && isSpace(byte(r)) })
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// parseCondition parses the text that follows "where".  Variables
+// start with sigil if it is not empty.
+func parseCondition(text, sigil string) (*condition, error) {
+	c := &condition{}
+	c.name, text = splitFirst(text)
+	c.name = canonicalVar(c.name, sigil)
+	if !isVarName(c.name) {
+		return nil, fmt.Errorf("condition must start with a variable, not %q", c.name)
+	}
+	c.op, text = splitFirst(text)
+	if c.op == "not" {
+		c.negate = true
+		c.op, text = splitFirst(text)
+	}
+	switch c.op {
+	case "contains", "matches":
+		if text == "" {
+			return nil, fmt.Errorf("missing pattern after %s", c.op)
+		}
+		p := parsePattern([]byte(text), sigil)
+		if errs := checkBrackets("pattern", p); len(errs) > 0 {
+			return nil, errors.New(errs[0])
+		}
+		c.pat = makeListPattern(p.children, c.op == "matches", make(map[string]rune))
+	case "equals":
+		c.other = canonicalVar(text, sigil)
+		if !isVarName(c.other) {
+			return nil, fmt.Errorf("equals must be followed by a variable, not %q", c.other)
+		}
+	case "=~", "!~":
+		if c.negate {
+			return nil, fmt.Errorf("use !~ instead of not %s", c.op)
+		}
+		c.negate = c.op == "!~"
+		c.op = "=~"
+		if len(text) >= 2 && text[0] == '/' && text[len(text)-1] == '/' {
+			text = text[1 : len(text)-1]
+		}
+		re, err := regexp.Compile(text)
+		if err != nil {
+			return nil, err
+		}
+		c.re = re
+	default:
+		return nil, fmt.Errorf("unknown condition %q", c.op)
+	}
+	return c, nil
+}
+
+// canonicalVar returns variable name v, written with sigil, in the
+// usual $ form.
+func canonicalVar(v, sigil string) string {
+	if sigil != "" && strings.HasPrefix(v, sigil) {
+		return "$" + v[len(sigil):]
+	}
+	return v
+}
+
+// accept returns true iff match m satisfies every condition in r.
+func (r *rule) accept(m match) bool {
+	for _, c := range r.where {
+		if c.holds(m) == c.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// inContext returns true iff the nodes list.children[start:limit]
+// satisfy the inside and not-inside restrictions of r.
+func (r *rule) inContext(list *node, start, limit int) bool {
+	for _, p := range r.inside {
+		if !r.encloses(p, list, start, limit) {
+			return false
+		}
+	}
+	for _, p := range r.notInside {
+		if r.encloses(p, list, start, limit) {
+			return false
+		}
+	}
+	return true
+}
+
+// inLines returns true iff r is not restricted to some lines of the
+// input or the tokens of list (or the comment tokens if any) overlap
+// one of the lines of r.  Tokens inserted by earlier replacements are
+// ignored since they have no input lines.
+func (r *rule) inLines(list []*node, comments ...token) bool {
+	if r.lines == nil {
+		return true
+	}
+	first, last := 0, 0
+	add := func(t token) {
+		l := t.line + strings.Count(strings.TrimSuffix(t.text, "\n"), "\n")
+		if first == 0 || t.line < first {
+			first = t.line
+		}
+		if l > last {
+			last = l
+		}
+	}
+	for _, t := range comments {
+		add(t)
+	}
+	for _, n := range list {
+		for _, l := range leaves(n) {
+			if !l.replaced && l.token.ttype != END {
+				add(l.token)
+			}
+		}
+	}
+	for _, lr := range r.lines {
+		if first <= lr.last && lr.first <= last {
+			return true
+		}
+	}
+	return false
+}
+
+// encloses returns true iff p matches a run of nodes that includes
+// list.children[start:limit], or a run of nodes that includes an
+// ancestor of list.  Parent pointers are used to walk up the tree.
+// The reach of p in each list is cached in r.reach until a replacement
+// is made in the list or one of its descendants.
+func (r *rule) encloses(p *pattern, list *node, start, limit int) bool {
+	if r.reach == nil {
+		r.reach = make(map[*pattern]map[*node][]int)
+	}
+	cache := r.reach[p]
+	if cache == nil {
+		cache = make(map[*node][]int)
+		r.reach[p] = cache
+	}
+	for n := list; ; n = n.parent {
+		reach, ok := cache[n]
+		if !ok {
+			reach = p.reach(n.children)
+			cache[n] = reach
+		}
+		if reach[start] >= limit {
+			return true
+		}
+		if n.parent == nil {
+			return false
+		}
+		start = indexOf(n.parent.children, n)
+		limit = start + 1
+	}
+}
+
+// makeContextPattern returns the pattern for an inside or not-inside
+// directive.  Repeated variables at the top level of n are made lazy,
+// so that the match that encloses a node is the shortest one: with
+// "#if 0 $_* #endif", code between two disabled regions is not inside
+// either of them.
+func makeContextPattern(n *node) *pattern {
+	for _, c := range n.children {
+		if c.children == nil && c.token.ttype == RVAR {
+			if _, _, lazy := repeatBounds(c.token.text); !lazy {
+				c.token.text += "?"
+			}
+		}
+	}
+	return makePattern(n)
+}
+
+// changed discards cached context information for list and its
+// ancestors after list has been modified.
+func (r *rule) changed(list *node) {
+	for _, cache := range r.reach {
+		for n := list; n != nil; n = n.parent {
+			delete(cache, n)
+		}
+	}
+}
+
+// indexOf returns the index of n in list, or -1 if n is not in list.
+func indexOf(list []*node, n *node) int {
+	for i, c := range list {
+		if c == n {
+			return i
+		}
+	}
+	return -1
+}
+
+// holds returns true iff m satisfies c, ignoring c.negate.
+func (c *condition) holds(m match) bool {
+	vals, _ := m.lookup(c.name)
+	switch c.op {
+	case "contains":
+		_, ok := c.pat.search(vals)
+		return ok
+	case "matches":
+		if len(vals) == 1 && vals[0].children != nil {
+			vals = vals[0].children
+		}
+		_, ok := c.pat.match(vals)
+		return ok
+	case "equals":
+		other, _ := m.lookup(c.other)
+		return sameTokens(vals, other)
+	case "=~":
+		return c.re.MatchString(innerText(vals))
+	}
+	return false
+}
+
+// sameTokens returns true iff a and b hold the same sequence of tokens,
+// ignoring spaces and comments.
+func sameTokens(a, b []*node) bool {
+	var ta, tb []string
+	for _, n := range a {
+		perNode(n, func(c *node) {
+			if c.children == nil {
+				ta = append(ta, c.token.text)
+			}
+		})
+	}
+	for _, n := range b {
+		perNode(n, func(c *node) {
+			if c.children == nil {
+				tb = append(tb, c.token.text)
+			}
+		})
+	}
+	return strings.Join(ta, "\x00") == strings.Join(tb, "\x00")
+}
+
+// validate checks r for problems before any input is processed.  See
+// the validate function for details.
+func (r *rule) validate() (errs, warnings []string) {
+	var commentVars []string
+	for _, c := range r.comments {
+		commentVars = append(commentVars, c.names...)
+	}
+	bound := make(map[string]bool)
+	if c, ok := commentRule(r.pattern); ok {
+		// The replacement must be a comment that uses only the
+		// variables of the pattern, or nothing.
+		for _, name := range makeCommentPattern(c.text).names {
+			bound[name] = true
+		}
+		if rc, ok := commentRule(r.replacement); ok {
+			errs = append(errs, checkCommentVars(rc, bound)...)
+		} else if !isEmpty(r.replacement) {
+			errs = append(errs, "replacement for a comment must be a single comment or empty")
+		}
+	} else {
+		errs, warnings = validate(r.pattern, r.replacement, commentVars)
+		bound = patternVars(r.pattern)
+	}
+	for _, name := range commentVars {
+		bound[name] = true
+	}
+	for _, c := range r.where {
+		for _, v := range []string{c.name, c.other} {
+			if v != "" && !bound[v] {
+				errs = append(errs, fmt.Sprintf("where %d: variable %s is not bound by the pattern", c.line, v))
+			}
+		}
+	}
+	return errs, warnings
+}
+
+// patternVars returns the names of the variables bound by pattern,
+// without repetition suffixes.
+func patternVars(pattern *node) map[string]bool {
+	bound := make(map[string]bool)
+	perNode(pattern, func(n *node) {
+		if n.children != nil {
+			return
+		}
+		if name := varName(n.token); name != "" {
+			bound[baseName(name)] = true
+		}
+		var pieces []string
+		var isVar []bool
+		switch n.token.ttype {
+		case WVAR:
+			pieces = splitWord(n.token.text)
+			for _, piece := range pieces {
+				isVar = append(isVar, piece[0] == '$')
+			}
+		case STRING:
+			pieces, isVar = splitString(n.token.text)
+		}
+		for i, piece := range pieces {
+			if isVar[i] {
+				bound[wordVarName(piece)] = true
+			}
+		}
+	})
+	return bound
+}
+
+// isEmpty returns true iff tree n holds no tokens and no comments.
+func isEmpty(n *node) bool {
+	empty := true
+	perNode(n, func(c *node) {
+		if c.children != nil {
+			return
+		}
+		for _, t := range append(append([]token{c.token}, c.token.prefix...), c.token.suffix...) {
+			if t.ttype != END && t.ttype != SPACE {
+				empty = false
+			}
+		}
+	})
+	return empty
+}
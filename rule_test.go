@@ -0,0 +1,221 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		err  string
+	}{
+		{"f($x)\ng($x)\n", "1: no separator line"},
+		{"f($x)\n---\ng($x)\n---\nwhere x matches 1\n", `5: condition must start with a variable, not "x"`},
+		{"f($x)\n---\ng($x)\n---\n\n# comment\nwhere $x is 1\n", `7: unknown condition "is"`},
+		{"f($x)\n---\ng($x)\n---\nwhere $x equals 1\n", `5: equals must be followed by a variable, not "1"`},
+		{"f($x)\n---\ng($x)\n---\nwhere $x =~ /(/\n", "5: error parsing regexp"},
+		{"f($x)\n---\ng($x)\n---\nwhere $x not =~ /a/\n", "5: use !~ instead of not =~"},
+		{"f($x)\n---\ng($x)\n---\nunless $x\n", `5: unknown directive "unless"`},
+		{"f($x)\n---\ng($x)\n---\nsigil: @x\n", `5: sigil "@x" must not contain`},
+		{"f($x)\n---\ng($x)\n---\nsigil: @@\nsigil: %\n", `6: sigil "%" conflicts with earlier sigil "@@"`},
+		{"f($x)\n---\ng($x)\n---\nensure-line:\n", "5: missing line text"},
+		{"f($x)\n---\ng($x)\n---\nremove-line: #include <x.h> unless-used\n", "5: missing words after unless-used"},
+	} {
+		_, err := parseRule([]byte(c.text))
+		if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+			t.Errorf("parseRule(%q): got error %v, expecting %q", c.text, err, c.err)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	r, err := parseRule([]byte("f($x)\n---\ng($x)\n---\n# comment\n\nwhere $x !~ /a/\nwhere $x not contains b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.where) != 2 || r.where[0].line != 7 || !r.where[0].negate || r.where[1].op != "contains" {
+		t.Errorf("got conditions %+v", r.where)
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	r, err := parseRule([]byte("f($x)\n---\ng($x)\n---\nwhere $y equals $x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs, _ := r.validate()
+	expect := "where 5: variable $y is not bound by the pattern"
+	if len(errs) != 1 || errs[0] != expect {
+		t.Errorf("got errors %q, expecting %q", errs, expect)
+	}
+}
+
+func TestWhere(t *testing.T) {
+	for _, c := range []struct {
+		subject     string
+		pattern     string
+		replacement string
+		where       string
+		output      string
+	}{
+		// Regular expression tests on captured text.
+		{`strcpy(a, "x"); strcpy(a, b);`, "strcpy($d, $s)", "strlcpy($d, $s)", `$s !~ /^"/`, `strcpy(a, "x"); strlcpy(a, b);`},
+		{"f(ab); f(b); f(ba)", "f($x)", "g($x)", "$x =~ ^a", "g(ab); f(b); f(ba)"},
+
+		// Rejected matches let the search continue.
+		{"g(f(1), f(2), f(3))", "f($x),", "", "$x =~ /2/", "g(f(1),  f(3))"},
+
+		// contains and matches.
+		{"f(a + b); f(a * b); f(g(a + b))", "f($x)", "g($x)", "$x not contains $_ + $_", "f(a + b); g(a * b); f(g(a + b))"},
+		{"f(a + b); f(a * b); f(g(a + b))", "f($x*)", "g($x*)", "$x matches $_ + $_", "g(a + b); f(a * b); f(g(a + b))"},
+		{"f((a + b)); f(c)", "f($x)", "g($x)", "$x not matches ($_*)", "f((a + b)); g(c)"},
+
+		// equals compares tokens, ignoring spaces and comments.
+		{"x = x; y = z; a.b = a . b /* same */;", "$a* = $b*;", "", "$a equals $b", " y = z; /* same */"},
+	} {
+		r := &rule{pattern: parsePattern([]byte(c.pattern), ""), replacement: parsePattern([]byte(c.replacement), "")}
+		if err := r.addDirective(1, "where "+c.where); err != nil {
+			t.Errorf("where %s: %v", c.where, err)
+			continue
+		}
+		sub := parse([]byte(c.subject))
+		replace(sub, r)
+		if got := string(sub.serialize()); got != c.output {
+			t.Errorf("replace %q by %q where %s in %q: got %q, expecting %q", c.pattern, c.replacement, c.where, c.subject, got, c.output)
+		}
+	}
+}
+
+func TestRuleSections(t *testing.T) {
+	// The newline that ends a section is not part of it.
+	r, err := parseRule([]byte("f($x)\n---\ng($x)\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(r.replacement.serialize()); got != "g($x)" {
+		t.Errorf("replacement: got %q, expecting %q", got, "g($x)")
+	}
+}
+
+func TestInside(t *testing.T) {
+	const subject = `extern "C" { void f(int a) { x; } } void g() { x; } x;`
+	for _, c := range []struct {
+		directive string
+		output    string
+	}{
+		{"inside: f($_*) {$_*}", `extern "C" { void f(int a) { y; } } void g() { x; } x;`},
+		{`inside: extern "C" {$_*}`, `extern "C" { void f(int a) { y; } } void g() { x; } x;`},
+		{"inside: {$_*}", `extern "C" { void f(int a) { y; } } void g() { y; } x;`},
+		{"not-inside: {$_*}", `extern "C" { void f(int a) { x; } } void g() { x; } y;`},
+		{"not-inside: g() {$_*}", `extern "C" { void f(int a) { y; } } void g() { x; } y;`},
+
+		// Enclosing runs of nodes at the same level.
+		{"not-inside: void g() {$_*} x;", `extern "C" { void f(int a) { y; } } void g() { x; } x;`},
+	} {
+		r := &rule{pattern: parse([]byte("x;")), replacement: parse([]byte("y;"))}
+		if err := r.addDirective(1, c.directive); err != nil {
+			t.Errorf("%s: %v", c.directive, err)
+			continue
+		}
+		sub := parse([]byte(subject))
+		replace(sub, r)
+		if got := string(sub.serialize()); got != c.output {
+			t.Errorf("%s: got %q, expecting %q", c.directive, got, c.output)
+		}
+	}
+}
+
+func TestInsideShortest(t *testing.T) {
+	// Each match encloses as little as possible, so the code between
+	// two disabled regions is not inside either of them.
+	const subject = "#if 0\nx;\n#endif\nx;\n#if 0\nx;\n#endif\n"
+	const output = "#if 0\nx;\n#endif\ny;\n#if 0\nx;\n#endif\n"
+	for _, directive := range []string{"not-inside: #if 0 $_* #endif", "not-inside: #if 0 $_*? #endif"} {
+		r := &rule{pattern: parse([]byte("x;")), replacement: parse([]byte("y;"))}
+		if err := r.addDirective(1, directive); err != nil {
+			t.Fatalf("%s: %v", directive, err)
+		}
+		sub := parse([]byte(subject))
+		replace(sub, r)
+		if got := string(sub.serialize()); got != output {
+			t.Errorf("%s: got %q, expecting %q", directive, got, output)
+		}
+	}
+}
+
+func TestInsideReplaced(t *testing.T) {
+	// The context of later matches includes earlier replacements.
+	r := &rule{pattern: parse([]byte("x;")), replacement: parse([]byte("y;"))}
+	if err := r.addDirective(1, "not-inside: y; x;"); err != nil {
+		t.Fatal(err)
+	}
+	sub := parse([]byte("x; x; { x; x; }"))
+	replace(sub, r)
+	if got, want := string(sub.serialize()), "y; x; { y; x; }"; got != want {
+		t.Errorf("got %q, expecting %q", got, want)
+	}
+}
+
+func TestCommutative(t *testing.T) {
+	for _, c := range []struct {
+		subject     string
+		pattern     string
+		replacement string
+		ops         string
+		output      string
+	}{
+		{"if (NULL==p) f(); if (q==NULL) g();", "$x == NULL", "!$x", "", "if (!p) f(); if (!q) g();"},
+		{"a-1; 1-a; 1+a;", "$x - 1", "dec($x)", "", "dec(a); 1-a; 1+a;"},
+		{"1 + a; 2 * a;", "$x + 1", "inc($x)", "+", "inc(a); 2 * a;"},
+		{"0 != p && q", "$a && $p != 0", "ok($a, $p)", "all", "ok(q, p )"},
+		{"f(0 != p); f(0 == p)", "f($p != 0)", "g($p)", "==", "f(0 != p); f(0 == p)"},
+	} {
+		r := &rule{pattern: parsePattern([]byte(c.pattern), ""), replacement: parsePattern([]byte(c.replacement), "")}
+		if err := r.addCommutative(c.ops); err != nil {
+			t.Errorf("commutative %s: %v", c.ops, err)
+			continue
+		}
+		sub := parse([]byte(c.subject))
+		replace(sub, r)
+		if got := string(sub.serialize()); got != c.output {
+			t.Errorf("replace %q by %q in %q: got %q, expecting %q", c.pattern, c.replacement, c.subject, got, c.output)
+		}
+	}
+
+	r := &rule{}
+	if err := r.addCommutative("==, -"); err == nil {
+		t.Errorf("commutative - was accepted")
+	}
+}
+
+func TestSigil(t *testing.T) {
+	for _, c := range []struct {
+		subject string
+		rule    string
+		output  string
+	}{
+		{"a=$(ls); b=$(pwd);", "$(@@cmd)\n---\n`@@cmd`\n---\nsigil: @@\n", "a=`ls`; b=`pwd`;"},
+		{"$x + $y", "$x + @@y\n---\n@@y\n---\nsigil: @@\nwhere @@y =~ ^[$]\n", "$y"},
+		{"$x + y", "@@@@x + @@y\n---\n@@y\n---\nsigil: @@\n", "$x + y"},
+		{"$x + y", "$$x + $y\n---\n$y\n", "y"},
+		{"a$b + c", "a$$b + $x\n---\n$x\n", "c"},
+		{`\$x + y`, "\\$x + @@y\n---\n@@y\n---\nsigil: @@\n", "y"},
+		{`\$z + y`, "\\$x + @@y\n---\n@@y\n---\nsigil: @@\n", `\$z + y`},
+		{`f("$"); f("x");`, "f(\"$\")\n---\ng(\"$\")\n---\nsigil: @@\n", `g("$"); f("x");`},
+		{`f("$HOME");`, "\"$HOME\"\n---\n\"$PATH\"\n---\nsigil: @@\n", `f("$PATH");`},
+		{`f("cost: $5");`, "\"cost: $$5\"\n---\n\"$$\"\n", `f("$");`},
+		{"f(1);", "f(@@x)\n---\n/* $ @@x $$ */ g(@@x)\n---\nsigil: @@\n", "/* $ 1 $$ */ g(1);"},
+	} {
+		r, err := parseRule([]byte(c.rule))
+		if err != nil {
+			t.Errorf("parseRule(%q): %v", c.rule, err)
+			continue
+		}
+		sub := parse([]byte(c.subject))
+		replace(sub, r)
+		if got := string(sub.serialize()); got != c.output {
+			t.Errorf("replace(%q, %q): got %q, expecting %q", c.subject, c.rule, got, c.output)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 type tokenType int
 
@@ -15,10 +19,13 @@ const (
 	OTHER
 	OPENER
 	CLOSER
+	EXPR // ${...} expression in a replacement
+	WVAR // Word with embedded variables, e.g., get_$field
+	ALT  // Alternation, e.g., $[malloc|calloc] or $fn:[malloc|calloc]
 )
 
 var ttypeStrings = [...]string{
-	"END", "STRING", "COMMENT", "WORD", "SPACE", "VAR", "RVAR", "OTHER", "OPENER", "CLOSER",
+	"END", "STRING", "COMMENT", "WORD", "SPACE", "VAR", "RVAR", "OTHER", "OPENER", "CLOSER", "EXPR", "WVAR", "ALT",
 }
 
 func (t tokenType) String() string {
@@ -53,10 +60,31 @@ type tokenizer struct {
 	peek     token   // Next non-space/non-comment token.
 	line     int
 	column   int
+
+	// Token types by leading byte: scandata for input text, or
+	// patternScandata for patterns and replacements.
+	scan *scanner
+
+	// If true, $$ and \$ stand for a literal $, as in $$name.  Only
+	// patterns and replacements are read with escapes.  If backslash
+	// is false, only $$ does.
+	escapes   bool
+	backslash bool
 }
 
 func newTokenizer(data []byte) *tokenizer {
-	t := &tokenizer{input: data, line: 1}
+	return startTokenizer(&tokenizer{input: data, line: 1, scan: &scandata})
+}
+
+// newPatternTokenizer returns a tokenizer for a pattern or replacement.
+// If backslash is false, \$ is a backslash followed by a $, as needed
+// for text rewritten by replaceSigil.
+func newPatternTokenizer(data []byte, backslash bool) *tokenizer {
+	return startTokenizer(&tokenizer{input: data, line: 1, scan: &patternScandata, escapes: true, backslash: backslash})
+}
+
+// startTokenizer reads the first token into t.peek.
+func startTokenizer(t *tokenizer) *tokenizer {
 	for {
 		t.peek = t.readRaw()
 		if t.peek.ttype != COMMENT && t.peek.ttype != SPACE {
@@ -104,7 +132,12 @@ type scanEntry struct {
 	fn     func([]byte) (tokenType, int)
 }
 
-var scandata scanner
+// scandata holds the token types of input text.  patternScandata adds
+// the syntax that only patterns and replacements have: ${...}
+// expressions, $[...] alternations, repetition suffixes other than *,
+// and variables embedded in words.  In input text, as in a shell
+// script that contains ${HOME}, these are ordinary tokens.
+var scandata, patternScandata scanner
 
 func init() {
 	// For now just process C/C++ syntax.
@@ -116,7 +149,7 @@ func init() {
 	scandata['}'] = []scanEntry{{"", CLOSER, nil}}
 
 	// Special variable length tokens.
-	scandata['$'] = []scanEntry{{fn: readVar}}
+	scandata['$'] = []scanEntry{{fn: readInputVar}}
 	scandata['"'] = []scanEntry{{fn: readDblString}}
 	scandata['\''] = []scanEntry{{fn: readSingleString}}
 	scandata['/'] = []scanEntry{
@@ -128,7 +161,7 @@ func init() {
 		if isSpace(byte(b)) {
 			scandata[b] = []scanEntry{{fn: readSpaces}}
 		} else if isWordByte(byte(b)) {
-			scandata[b] = []scanEntry{{fn: readWord}}
+			scandata[b] = []scanEntry{{fn: readInputWord}}
 		}
 	}
 
@@ -141,6 +174,14 @@ func init() {
 		b := int(op[0])
 		scandata[b] = append(scandata[b], scanEntry{op[1:], OTHER, nil})
 	}
+
+	patternScandata = scandata
+	patternScandata['$'] = []scanEntry{{fn: readVar}}
+	for b := range patternScandata {
+		if isWordByte(byte(b)) {
+			patternScandata[b] = []scanEntry{{fn: readWord}}
+		}
+	}
 }
 
 func (t *tokenizer) readRaw() token {
@@ -150,8 +191,23 @@ func (t *tokenizer) readRaw() token {
 		return token{ttype: END, line: t.line, column: t.column + 1}
 	}
 
-	end, ttype := 1, OTHER // If no match in scandata, token is next byte
-	for _, e := range scandata[in[0]] {
+	end, ttype := 1, OTHER // If no match in t.scan, token is next byte
+	text := ""             // Token text if it differs from in[:end]
+	if n := t.escapeLength(in); n > 0 {
+		// Literal $, along with the rest of the input token it
+		// starts.
+		end = n
+		text = "$" + string(in[2:n])
+		if n == 2 {
+			ttype = OTHER
+		} else {
+			ttype = WORD
+		}
+	}
+	for _, e := range t.scan[in[0]] {
+		if text != "" {
+			break
+		}
 		slen := 1 + len(e.suffix)
 		if n >= slen && string(in[1:slen]) == e.suffix {
 			if e.fn == nil {
@@ -163,13 +219,15 @@ func (t *tokenizer) readRaw() token {
 			break
 		}
 	}
-
 	tok := token{
 		ttype:  ttype,
 		line:   t.line,
 		column: t.column + 1,
 		text:   string(in[:end]),
 	}
+	if text != "" {
+		tok.text = text
+	}
 	t.input = in[end:]
 
 	// Update line and column numbers.
@@ -189,6 +247,20 @@ func (t *tokenizer) readRaw() token {
 	return tok
 }
 
+// escapeLength returns the length of the escaped dollar sign ($$ or
+// \$) at the start of in, or zero if in does not start with one or t
+// does not handle escapes.  The length includes the rest of the token
+// that the $ starts in input text, e.g., "$$x*" stands for the single
+// input token "$x*".  Since input words never contain a $, "a$$b"
+// stands for the two input tokens "a" and "$b".
+func (t *tokenizer) escapeLength(in []byte) int {
+	if !t.escapes || len(in) < 2 || in[1] != '$' || (in[0] != '$' && (in[0] != '\\' || !t.backslash)) {
+		return 0
+	}
+	_, n := readInputVar(in[1:])
+	return 1 + n
+}
+
 func isSpace(b byte) bool {
 	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
 }
@@ -240,31 +312,329 @@ func readMultiLineComment(in []byte) (tokenType, int) {
 	return COMMENT, len(in)
 }
 
+// readInputWord reads a word of input text.
+func readInputWord(in []byte) (tokenType, int) {
+	return WORD, wordLength(in)
+}
+
+// readInputVar reads a variable in input text: $name, optionally
+// followed by *.  Other pattern syntax is not recognized, so a $ that
+// is not followed by a word is a token of its own.
+func readInputVar(in []byte) (tokenType, int) {
+	end := 1 + wordLength(in[1:])
+	if end == 1 {
+		return OTHER, 1
+	}
+	if end < len(in) && in[end] == '*' {
+		return RVAR, end + 1
+	}
+	return VAR, end
+}
+
+// readWord reads a word of a pattern.  Variables embedded in the word, as in
+// get_$field, turn it into a WVAR.
 func readWord(in []byte) (tokenType, int) {
-	for i, n := 1, len(in); i < n; i++ {
+	return continueWord(in, WORD, wordLength(in))
+}
+
+func wordLength(in []byte) int {
+	for i, n := 0, len(in); i < n; i++ {
 		if !isWordByte(in[i]) {
-			return WORD, i
+			return i
 		}
 	}
-	return WORD, len(in)
+	return len(in)
 }
 
+// readVar reads a variable, alternation or expression in a pattern.
 func readVar(in []byte) (tokenType, int) {
-	ttype := OTHER
-	end := 1
-	if len(in) > 1 && isWordByte(in[1]) {
-		ttype = VAR
-		_, end = readWord(in[1:])
-		end++
-		// Optional trailing '*'
-		if end < len(in) && in[end] == '*' {
-			ttype = RVAR
-			end++
+	if len(in) > 1 && in[1] == '[' {
+		return readAlt(in, 1)
+	}
+	end := varLength(in)
+	if end == 0 {
+		return OTHER, 1
+	}
+	if in[1] == '{' {
+		return continueWord(in, EXPR, end)
+	}
+	if end+1 < len(in) && in[end] == ':' && in[end+1] == '[' {
+		return readAlt(in, end+1)
+	}
+	// Optional repetition suffix
+	if q := readRepeat(in, end); q > end {
+		return RVAR, q
+	}
+	return continueWord(in, VAR, end)
+}
+
+// readRepeat returns the end of the repetition suffix (*, +, ?, {m,n},
+// each optionally followed by ? to make it lazy) that starts at
+// in[end], or end if there is none.  So that $a+$b and $a?$b:$c keep
+// their usual meaning, + and ? only count if followed by a space, a
+// closing bracket, a comma, a semicolon or the end of the input.
+func readRepeat(in []byte, end int) int {
+	if end >= len(in) {
+		return end
+	}
+	q := end
+	switch in[q] {
+	case '*', '+', '?':
+		q++
+	case '{':
+		n := countedRepeatLength(in[q:])
+		if n == 0 {
+			return end
+		}
+		q += n
+	default:
+		return end
+	}
+	if q < len(in) && in[q] == '?' && isRepeatEnd(in, q+1) {
+		q++ // Lazy
+	}
+	if (in[end] == '+' || in[end] == '?') && !isRepeatEnd(in, q) {
+		return end
+	}
+	return q
+}
+
+// countedRepeatLength returns the length of {m}, {m,} or {m,n} at the
+// start of in, or zero if in does not start with one.
+func countedRepeatLength(in []byte) int {
+	i := 1
+	digits := func() int {
+		start := i
+		for i < len(in) && inRange(in[i], '0', '9') {
+			i++
 		}
+		return i - start
+	}
+	if digits() == 0 {
+		return 0
+	}
+	if i < len(in) && in[i] == ',' {
+		i++
+		digits()
+	}
+	if i < len(in) && in[i] == '}' {
+		return i + 1
+	}
+	return 0
+}
+
+func isRepeatEnd(in []byte, i int) bool {
+	return i >= len(in) || isSpace(in[i]) || strings.IndexByte(")]},;", in[i]) >= 0
+}
+
+// repeatBounds returns the minimum and maximum (-1 if unbounded)
+// number of nodes a repeated variable such as $x* or $x{2,3} matches,
+// and whether it is lazy.
+func repeatBounds(text string) (min, max int, lazy bool) {
+	end := 1 + wordLength([]byte(text[1:]))
+	q := text[end:]
+	if len(q) > 1 && strings.HasSuffix(q, "?") {
+		lazy = true
+		q = q[:len(q)-1]
+	}
+	switch q {
+	case "*":
+		return 0, -1, lazy
+	case "+":
+		return 1, -1, lazy
+	case "?":
+		return 0, 1, lazy
+	}
+	q = strings.Trim(q, "{}")
+	parts := strings.SplitN(q, ",", 2)
+	min, _ = strconv.Atoi(parts[0])
+	max = min
+	if len(parts) == 2 {
+		max = -1
+		if parts[1] != "" {
+			max, _ = strconv.Atoi(parts[1])
+		}
+	}
+	return min, max, lazy
+}
+
+// readAlt reads an alternation such as $[a|b] or $x:[a|b], where the
+// opening bracket is at in[open].
+func readAlt(in []byte, open int) (tokenType, int) {
+	depth := 0
+	for i, n := open, len(in); i < n; i++ {
+		switch in[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return ALT, i + 1
+			}
+		}
+	}
+	return ALT, len(in)
+}
+
+// splitAlt splits the text of an ALT token into the variable it binds
+// (empty for $[...]) and the list of alternatives.
+func splitAlt(text string) (string, []string) {
+	open := strings.IndexByte(text, '[')
+	name := strings.TrimSuffix(text[:open], ":")
+	if name == "$" {
+		name = ""
+	}
+	body := strings.TrimSuffix(text[open+1:], "]")
+	var alts []string
+	for _, a := range strings.Split(body, "|") {
+		alts = append(alts, strings.TrimSpace(a))
+	}
+	return name, alts
+}
+
+// varLength returns the length of the variable reference ($name or
+// ${...}) at the start of in, or zero if in does not start with one.
+func varLength(in []byte) int {
+	if len(in) < 2 || in[0] != '$' {
+		return 0
+	}
+	if in[1] == '{' {
+		_, n := readExpr(in)
+		return n
+	}
+	return 1 + wordLength(in[1:])
+}
+
+// continueWord extends a token of type ttype that ends at end with
+// any directly following word text and variable references.  If
+// anything is added, the result is a WVAR.  Adjacent variables with no
+// word text, as in $a$b, are left as separate tokens.
+func continueWord(in []byte, ttype tokenType, end int) (tokenType, int) {
+	hasText := ttype == WORD
+	for end < len(in) {
+		n := 0
+		if hasText {
+			// A $ that does not start a variable name ends the
+			// word.
+			if n = varLength(in[end:]); n == 1 {
+				n = 0
+			}
+		}
+		if n == 0 {
+			n = wordLength(in[end:])
+			hasText = hasText || n > 0
+		}
+		if n == 0 {
+			break
+		}
+		end += n
+		ttype = WVAR
 	}
 	return ttype, end
 }
 
+// splitWord splits the text of a WVAR token into pieces.  Variable
+// references ($name or ${...}) start with '$', and other pieces are
+// literal text.
+func splitWord(text string) []string {
+	var pieces []string
+	in := []byte(text)
+	for len(in) > 0 {
+		n := varLength(in)
+		if n == 0 {
+			n = wordLength(in)
+		}
+		if n == 0 {
+			n = 1
+		}
+		pieces = append(pieces, string(in[:n]))
+		in = in[n:]
+	}
+	return pieces
+}
+
+// splitString splits the text of a STRING token into the pieces of its
+// body.  Variable references ($name or ${...}) are returned with
+// isVar set; other pieces hold the literal text as written, including
+// escape sequences.  $$ stands for a literal $.
+func splitString(text string) (pieces []string, isVar []bool) {
+	if len(text) < 2 || text[len(text)-1] != text[0] {
+		return []string{text}, []bool{false}
+	}
+	return splitText(text[1 : len(text)-1])
+}
+
+// splitText splits body into variable references and literal text as
+// described for splitString.
+func splitText(body string) (pieces []string, isVar []bool) {
+	lit := ""
+	for i := 0; i < len(body); {
+		switch n := varLength([]byte(body[i:])); {
+		case strings.HasPrefix(body[i:], "$$"):
+			lit += "$"
+			i += 2
+		case n > 1:
+			if lit != "" {
+				pieces, isVar = append(pieces, lit), append(isVar, false)
+				lit = ""
+			}
+			pieces, isVar = append(pieces, body[i:i+n]), append(isVar, true)
+			i += n
+		case body[i] == '\\' && i+1 < len(body):
+			lit += body[i : i+2]
+			i += 2
+		default:
+			lit += body[i : i+1]
+			i++
+		}
+	}
+	if lit != "" {
+		pieces, isVar = append(pieces, lit), append(isVar, false)
+	}
+	return pieces, isVar
+}
+
+// hasStringVars returns true iff t is a string literal that refers to
+// variables, as in "$prefix%lu", or escapes a dollar sign, as in
+// "$$HOME".  Such strings are matched and produced piece by piece.
+func hasStringVars(t token) bool {
+	if t.ttype != STRING {
+		return false
+	}
+	if strings.Contains(t.text, "$$") {
+		return true
+	}
+	_, isVar := splitString(t.text)
+	for _, v := range isVar {
+		if v {
+			return true
+		}
+	}
+	return false
+}
+
+// readExpr reads a "${...}" expression.  Braces nest, and braces
+// inside string literals are ignored.
+func readExpr(in []byte) (tokenType, int) {
+	// Caller guarantees in starts with "${"
+	depth := 0
+	for i, n := 1, len(in); i < n; i++ {
+		switch in[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return EXPR, i + 1
+			}
+		case '"', '\'':
+			_, slen := readString(in[i:], in[i])
+			i += slen - 1
+		}
+	}
+	return EXPR, len(in)
+}
+
 func readSpaces(in []byte) (tokenType, int) {
 	for i, n := 1, len(in); i < n; i++ {
 		if !isSpace(in[i]) {
@@ -281,7 +651,7 @@ func closerFor(opener string) string {
 	case "{":
 		return "}"
 	case "[":
-		return "}"
+		return "]"
 	default:
 		return ""
 	}
@@ -47,6 +47,14 @@ func TestTokenizer(t *testing.T) {
 		{" \t", ""},
 		{"$x", "(VAR 1.1 $x)"},
 		{"$x*", "(RVAR 1.1 $x*)"},
+		{"$", "(OTHER 1.1 $)"},
+
+		// Pattern syntax is ordinary text in the input.
+		{"${HOME}", "(OTHER 1.1 $)(OPENER 1.2 {)(WORD 1.3 HOME)(CLOSER 1.7 })"},
+		{"$x+ 1", "(VAR 1.1 $x)(OTHER 1.3 +)(WORD 1.5 1)"},
+		{"$x{2}", "(VAR 1.1 $x)(OPENER 1.3 {)(WORD 1.4 2)(CLOSER 1.5 })"},
+		{"$[a|b]", "(OTHER 1.1 $)(OPENER 1.2 [)(WORD 1.3 a)(OTHER 1.4 |)(WORD 1.5 b)(CLOSER 1.6 ])"},
+		{"get_$x", "(WORD 1.1 get_)(VAR 1.5 $x)"},
 
 		// Combination
 		{"a1b /*x\ny*/$a$b* 200", "(WORD 1.1 a1b)(VAR 2.4 $a)(RVAR 2.6 $b*)(WORD 2.10 200)"},
@@ -73,3 +81,53 @@ func TestTokenizer(t *testing.T) {
 		}
 	}
 }
+
+func TestPatternTokenizer(t *testing.T) {
+	for _, c := range []struct {
+		input  string
+		output string
+	}{
+		{"$$x $x", "(WORD 1.1 $x)(VAR 1.5 $x)"},
+		{`\$x = $$(a)`, "(WORD 1.1 $x)(OTHER 1.5 =)(OTHER 1.7 $)(OPENER 1.9 ()(WORD 1.10 a)(CLOSER 1.11 ))"},
+		{`a\b`, `(WORD 1.1 a)(OTHER 1.2 \)(WORD 1.3 b)`},
+		{`a$$b c\$d$$ $$e$$f`, "(WORD 1.1 a)(WORD 1.2 $b)(WORD 1.6 c)(WORD 1.7 $d)(OTHER 1.10 $)(WORD 1.13 $e)(WORD 1.16 $f)"},
+		{"get_$$x$y", "(WORD 1.1 get_)(WORD 1.5 $x)(VAR 1.8 $y)"},
+		{"$$x* $${HOME}", "(WORD 1.1 $x*)(OTHER 1.6 $)(OPENER 1.8 {)(WORD 1.9 HOME)(CLOSER 1.13 })"},
+
+		// Pattern syntax.
+		{"$x+)", "(RVAR 1.1 $x+)(CLOSER 1.4 ))"},
+		{"$x?", "(RVAR 1.1 $x?)"},
+		{"$x*?,", "(RVAR 1.1 $x*?)(OTHER 1.5 ,)"},
+		{"$x+? ", "(RVAR 1.1 $x+?)"},
+		{"$x{2,3}", "(RVAR 1.1 $x{2,3})"},
+		{"$x{2,}?;", "(RVAR 1.1 $x{2,}?)(OTHER 1.8 ;)"},
+		{"$x{2}", "(RVAR 1.1 $x{2})"},
+		{"$x{y}", "(VAR 1.1 $x)(OPENER 1.3 {)(WORD 1.4 y)(CLOSER 1.5 })"},
+		{"$a+$b", "(VAR 1.1 $a)(OTHER 1.3 +)(VAR 1.4 $b)"},
+		{"$a?$b:$c", "(VAR 1.1 $a)(OTHER 1.3 ?)(VAR 1.4 $b)(OTHER 1.6 :)(VAR 1.7 $c)"},
+		{"${x}", "(EXPR 1.1 ${x})"},
+		{`${trimprefix(x, "}")}_v2`, `(WVAR 1.1 ${trimprefix(x, "}")}_v2)`},
+		{"get_$x", "(WVAR 1.1 get_$x)"},
+		{"a$b${c}d$e*", "(WVAR 1.1 a$b${c}d$e)(OTHER 1.11 *)"},
+		{"${x}$y", "(EXPR 1.1 ${x})(VAR 1.5 $y)"},
+		{"$[a|b]($x)", "(ALT 1.1 $[a|b])(OPENER 1.7 ()(VAR 1.8 $x)(CLOSER 1.10 ))"},
+		{"$f:[a | b[]]", "(ALT 1.1 $f:[a | b[]])"},
+		{"$a[$i]", "(VAR 1.1 $a)(OPENER 1.3 [)(VAR 1.4 $i)(CLOSER 1.6 ])"},
+		{"$a: [x]", "(VAR 1.1 $a)(OTHER 1.3 :)(OPENER 1.5 [)(WORD 1.6 x)(CLOSER 1.7 ])"},
+		{"${x", "(EXPR 1.1 ${x)"},
+	} {
+		tokenizer := newPatternTokenizer([]byte(c.input), true)
+		var buf bytes.Buffer
+		for {
+			tok := tokenizer.read()
+			if tok.ttype == END {
+				break
+			}
+			fmt.Fprint(&buf, tok)
+		}
+		if result := buf.String(); result != c.output {
+			t.Errorf("PatternTokenizer(%#v):\nGot:\n%s\nExpect:\n%s\n",
+				c.input, result, c.output)
+		}
+	}
+}
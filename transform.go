@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// expr is a parsed "${...}" replacement expression.  It is either a
+// reference to a pattern variable, a string literal, or a call of a
+// transform function.
+type expr struct {
+	name string  // Variable or function name
+	lit  string  // Value of string literal
+	args []*expr // Arguments if this is a call
+	call bool    // True iff this is a call
+	str  bool    // True iff this is a string literal
+}
+
+// transform describes a function that can be called in an expression.
+// The first argument is the text being transformed, and nargs counts
+// all arguments including the first.
+type transform struct {
+	nargs int
+	fn    func(args []string) string
+}
+
+var transforms = map[string]transform{
+	"upper":      {1, func(a []string) string { return strings.ToUpper(a[0]) }},
+	"lower":      {1, func(a []string) string { return strings.ToLower(a[0]) }},
+	"snake":      {1, func(a []string) string { return snakeCase(a[0]) }},
+	"camel":      {1, func(a []string) string { return camelCase(a[0]) }},
+	"quote":      {1, func(a []string) string { return quoteString(a[0], '"') }},
+	"trimprefix": {2, func(a []string) string { return strings.TrimPrefix(a[0], a[1]) }},
+	"trimsuffix": {2, func(a []string) string { return strings.TrimSuffix(a[0], a[1]) }},
+}
+
+// parseExpr parses the text of an EXPR token, e.g., `${upper(x)}`.
+func parseExpr(text string) (*expr, error) {
+	if !strings.HasPrefix(text, "${") || !strings.HasSuffix(text, "}") {
+		return nil, fmt.Errorf("%s: missing closing brace", text)
+	}
+	p := &exprParser{text: text[2 : len(text)-1]}
+	e, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", text, err)
+	}
+	p.skipSpace()
+	if p.pos < len(p.text) {
+		return nil, fmt.Errorf("%s: unexpected %q", text, p.text[p.pos:])
+	}
+	return e, nil
+}
+
+// exprParser implements recursive descent parsing of expressions.
+type exprParser struct {
+	text string
+	pos  int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.text) && isSpace(p.text[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) parse() (*expr, error) {
+	p.skipSpace()
+	if p.pos >= len(p.text) {
+		return nil, errors.New("missing expression")
+	}
+	if c := p.text[p.pos]; c == '"' || c == '\'' {
+		_, n := readString([]byte(p.text[p.pos:]), c)
+		lit := p.text[p.pos : p.pos+n]
+		p.pos += n
+		if len(lit) < 2 || lit[len(lit)-1] != c {
+			return nil, errors.New("unterminated string")
+		}
+		return &expr{lit: unquoteString(lit), str: true}, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.text) && isWordByte(p.text[p.pos]) {
+		p.pos++
+	}
+	if start == p.pos {
+		return nil, fmt.Errorf("unexpected %q", p.text[p.pos:])
+	}
+	e := &expr{name: p.text[start:p.pos]}
+	p.skipSpace()
+	if p.pos >= len(p.text) || p.text[p.pos] != '(' {
+		return e, nil
+	}
+
+	// Function call
+	p.pos++
+	e.call = true
+	for {
+		arg, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		e.args = append(e.args, arg)
+		p.skipSpace()
+		if p.pos >= len(p.text) {
+			return nil, errors.New("missing )")
+		}
+		c := p.text[p.pos]
+		p.pos++
+		if c == ')' {
+			break
+		}
+		if c != ',' {
+			return nil, fmt.Errorf("unexpected %q", c)
+		}
+	}
+	return e, nil
+}
+
+// check returns an error if e calls unknown functions or calls
+// functions with the wrong number of arguments.
+func (e *expr) check() error {
+	if !e.call {
+		return nil
+	}
+	t, ok := transforms[e.name]
+	if !ok {
+		return fmt.Errorf("unknown function %s", e.name)
+	}
+	if len(e.args) != t.nargs {
+		return fmt.Errorf("%s takes %d arguments, not %d", e.name, t.nargs, len(e.args))
+	}
+	for _, a := range e.args {
+		if err := a.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vars calls fn for every variable referenced by e.
+func (e *expr) vars(fn func(name string)) {
+	switch {
+	case e.str:
+	case e.call:
+		for _, a := range e.args {
+			a.vars(fn)
+		}
+	default:
+		fn(e.name)
+	}
+}
+
+// eval returns the value of e, using lookup to find the text bound to
+// a variable.
+func (e *expr) eval(lookup func(name string) string) string {
+	switch {
+	case e.str:
+		return e.lit
+	case e.call:
+		args := make([]string, len(e.args))
+		for i, a := range e.args {
+			args[i] = a.eval(lookup)
+		}
+		return transforms[e.name].fn(args)
+	default:
+		return lookup(e.name)
+	}
+}
+
+// words splits an identifier into words at underscores and at
+// lower to upper case transitions.  E.g., "getHTTPServer_name" yields
+// "get", "HTTP", "Server", "name".
+func words(s string) []string {
+	var result []string
+	r := []rune(s)
+	start := 0
+	for i := 0; i <= len(r); i++ {
+		split := i == len(r) || r[i] == '_'
+		if !split && i > start {
+			prev := r[i-1]
+			next := i+1 < len(r) && unicode.IsLower(r[i+1])
+			split = unicode.IsUpper(r[i]) && (unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && next))
+		}
+		if !split {
+			continue
+		}
+		if i > start {
+			result = append(result, string(r[start:i]))
+		}
+		if i < len(r) && r[i] == '_' {
+			start = i + 1
+		} else {
+			start = i
+		}
+	}
+	return result
+}
+
+// snakeCase converts s to lower case words separated by underscores.
+func snakeCase(s string) string {
+	w := words(s)
+	for i := range w {
+		w[i] = strings.ToLower(w[i])
+	}
+	return strings.Join(w, "_")
+}
+
+// camelCase converts s to capitalized words with no separators, e.g.,
+// "foo_bar" becomes "FooBar".
+func camelCase(s string) string {
+	w := words(s)
+	for i := range w {
+		r := []rune(strings.ToLower(w[i]))
+		r[0] = unicode.ToUpper(r[0])
+		w[i] = string(r)
+	}
+	return strings.Join(w, "")
+}
+
+// quoteString returns s as a string literal with the specified delimiter.
+func quoteString(s string, delimiter byte) string {
+	var buf strings.Builder
+	buf.WriteByte(delimiter)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && keptEscape(s, i):
+			// unquoteString keeps this escape as written.
+			buf.WriteByte(c)
+		case c == delimiter || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c == '\n':
+			buf.WriteString(`\n`)
+		case c == '\t':
+			buf.WriteString(`\t`)
+		case c == '\r':
+			buf.WriteString(`\r`)
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(&buf, `\%03o`, c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte(delimiter)
+	return buf.String()
+}
+
+// unquoteString returns the contents of string literal s with escape
+// sequences replaced by the characters they represent.  Every C escape
+// sequence is decoded, with \u and \U yielding UTF-8.  Other escapes,
+// such as \d or a \x escape whose value does not fit in a byte, are
+// kept as written.
+func unquoteString(s string) string {
+	s = s[1 : len(s)-1]
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			buf.WriteByte(c)
+			continue
+		}
+		text, n, ok := decodeEscape(s[i+1:])
+		if !ok {
+			buf.WriteByte(c)
+			continue
+		}
+		buf.WriteString(text)
+		i += n
+	}
+	return buf.String()
+}
+
+// decodeEscape decodes the escape sequence that s starts with, which
+// is the text that follows a backslash.  It returns the text that the
+// sequence stands for and its length in s, or false if s does not
+// start with a C escape sequence.
+func decodeEscape(s string) (string, int, bool) {
+	switch c := s[0]; c {
+	case 'n':
+		return "\n", 1, true
+	case 't':
+		return "\t", 1, true
+	case 'r':
+		return "\r", 1, true
+	case 'a':
+		return "\a", 1, true
+	case 'b':
+		return "\b", 1, true
+	case 'f':
+		return "\f", 1, true
+	case 'v':
+		return "\v", 1, true
+	case '\\', '\'', '"', '?':
+		return s[:1], 1, true
+	case '0', '1', '2', '3', '4', '5', '6', '7':
+		v, n := 0, 0
+		for n < 3 && n < len(s) && s[n] >= '0' && s[n] <= '7' {
+			v = v*8 + int(s[n]-'0')
+			n++
+		}
+		if v > 0xff {
+			return "", 0, false
+		}
+		return string([]byte{byte(v)}), n, true
+	case 'x', 'u', 'U':
+		// \x takes any number of hex digits, \u four and \U
+		// eight.
+		max := map[byte]int{'x': len(s), 'u': 4, 'U': 8}[c]
+		v, n := 0, 0
+		for n < max && 1+n < len(s) && hexDigit(s[1+n]) >= 0 {
+			v = v*16 + hexDigit(s[1+n])
+			n++
+			if v > unicode.MaxRune {
+				return "", 0, false
+			}
+		}
+		switch {
+		case n == 0 || (c != 'x' && n < max):
+			return "", 0, false
+		case c == 'x' && v > 0xff:
+			return "", 0, false
+		case c == 'x':
+			return string([]byte{byte(v)}), 1 + n, true
+		case !utf8.ValidRune(rune(v)):
+			return "", 0, false
+		}
+		return string(rune(v)), 1 + n, true
+	}
+	return "", 0, false
+}
+
+// keptEscape returns true iff unquoteString keeps the backslash at
+// s[i] as written, and so quoteString can write it as is.
+func keptEscape(s string, i int) bool {
+	if i+1 == len(s) || s[i+1] < ' ' || s[i+1] == 0x7f {
+		return false
+	}
+	_, _, ok := decodeEscape(s[i+1:])
+	return !ok
+}
+
+// hexDigit returns the value of hexadecimal digit c, or -1 if c is
+// not a hexadecimal digit.
+func hexDigit(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10
+	}
+	return -1
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestCase(t *testing.T) {
+	type test struct {
+		input string
+		snake string
+		camel string
+	}
+	for _, c := range []test{
+		{"foo", "foo", "Foo"},
+		{"foo_bar", "foo_bar", "FooBar"},
+		{"fooBar", "foo_bar", "FooBar"},
+		{"FooBar", "foo_bar", "FooBar"},
+		{"getHTTPServer_name", "get_http_server_name", "GetHttpServerName"},
+		{"_x__y_", "x_y", "XY"},
+		{"md5Sum", "md5_sum", "Md5Sum"},
+	} {
+		if got := snakeCase(c.input); got != c.snake {
+			t.Errorf("snake(%s) = %s, expect %s", c.input, got, c.snake)
+		}
+		if got := camelCase(c.input); got != c.camel {
+			t.Errorf("camel(%s) = %s, expect %s", c.input, got, c.camel)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for _, s := range []string{"", "a", `a"b`, `a\b`, "a\nb\t\001", "'", "\a\b\f\v", `\d`, `\`, `\x41`, `\x41b`, `\\d`, "\\\n", "é"} {
+		for _, d := range []byte{'"', '\''} {
+			q := quoteString(s, d)
+			if u := unquoteString(q); u != s {
+				t.Errorf("unquote(quote(%q)) = %q via %s", s, u, q)
+			}
+		}
+	}
+	for _, c := range []struct {
+		literal string
+		text    string
+		requote string // quoteString(text, '\'')
+	}{
+		{`"a\x41"`, "aA", `'aA'`},
+		{`"a\x41b"`, `a\x41b`, `'a\x41b'`},
+		{`"\x4a\x4B"`, "JK", `'JK'`},
+		{`"\a\b\f\v"`, "\a\b\f\v", `'\007\010\014\013'`},
+		{`"\?\'\"\\"`, `?'"\`, `'?\'"\\'`},
+		{`"\u00e9\U0001F600"`, "é😀", `'é😀'`},
+		{`"\101\0"`, "A\000", `'A\000'`},
+		{`"\d\$"`, `\d\$`, `'\d\$'`},
+		{`"\x\u12\uD800\777"`, `\x\u12\uD800\777`, `'\x\u12\uD800\777'`},
+	} {
+		text := unquoteString(c.literal)
+		if text != c.text {
+			t.Errorf("unquote(%s) = %q, expecting %q", c.literal, text, c.text)
+		}
+		if q := quoteString(text, '\''); q != c.requote {
+			t.Errorf("quote(unquote(%s)) = %s, expecting %s", c.literal, q, c.requote)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validate checks a pattern and replacement for problems before any
+// input is processed.  Errors describe problems that would make
+// replace() silently do nothing or make substitute() fail.  Warnings
+// describe suspicious but legal constructs.  The replacement may also
+// use the variables in extra, which other parts of a rule (e.g.,
+// comment: directives) bind.
+func validate(pattern, replacement *node, extra []string) (errs, warnings []string) {
+	errorf := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	// Collect pattern variables and check that something can match.
+	bound := make(map[string]bool)   // Bound variables as written
+	bases := make(map[string]string) // Maps base name to bound name
+	var vars []token
+	nonEmpty := 0 // Number of pattern nodes that match at least one node
+	perNode(pattern, func(n *node) {
+		if n.children != nil || n.token.ttype == END {
+			return
+		}
+		t := n.token
+		bind := func(name string) {
+			if isAnonymous(name) {
+				return
+			}
+			if bases[baseName(name)] != "" {
+				errorf("pattern %d:%d: variable %s is used more than once (use $_ for parts that are not needed)", t.line, t.column, name)
+				return
+			}
+			v := t
+			v.text = name
+			vars = append(vars, v)
+			bound[name] = true
+			bases[baseName(name)] = name
+		}
+		switch t.ttype {
+		case EXPR:
+			errorf("pattern %d:%d: expression %s can only be used in the replacement", t.line, t.column, t.text)
+		case VAR:
+			bind(t.text)
+		case RVAR:
+			bind(t.text)
+			min, max, _ := repeatBounds(t.text)
+			if max >= 0 && min > max {
+				errorf("pattern %d:%d: %s repeats at least %d but at most %d times", t.line, t.column, t.text, min, max)
+			} else if max > 1000 || min > 1000 {
+				errorf("pattern %d:%d: %s repeats more than 1000 times", t.line, t.column, t.text)
+			}
+		case ALT:
+			name, alts := splitAlt(t.text)
+			if name != "" {
+				bind(name)
+			}
+			for _, a := range alts {
+				if !isSingleToken(a) {
+					errorf("pattern %d:%d: alternative %q in %s must be a single token", t.line, t.column, a, t.text)
+				}
+			}
+		case WVAR:
+			for _, piece := range splitWord(t.text) {
+				if piece[0] != '$' {
+					continue
+				}
+				name := wordVarName(piece)
+				if !isVarName(name) {
+					errorf("pattern %d:%d: %s in %s must be a variable name", t.line, t.column, piece, t.text)
+					continue
+				}
+				bind(name)
+			}
+		case STRING:
+			pieces, isVar := splitString(t.text)
+			for i, piece := range pieces {
+				if !isVar[i] {
+					continue
+				}
+				name := wordVarName(piece)
+				if !isVarName(name) {
+					errorf("pattern %d:%d: %s in %s must be a variable name", t.line, t.column, piece, t.text)
+					continue
+				}
+				bind(name)
+			}
+		}
+		if t.ttype != RVAR {
+			nonEmpty++
+		} else if min, _, _ := repeatBounds(t.text); min > 0 {
+			nonEmpty++
+		}
+	})
+	if nonEmpty == 0 && len(vars) == 0 {
+		errorf("pattern is empty")
+	} else if nonEmpty == 0 {
+		errorf("pattern consists only of repeated variables, so it can match an empty list")
+	}
+
+	for _, name := range extra {
+		if bases[baseName(name)] == "" {
+			bound[name] = true
+			bases[baseName(name)] = name
+		}
+	}
+
+	errs = append(errs, checkBrackets("pattern", pattern)...)
+	errs = append(errs, checkBrackets("replacement", replacement)...)
+
+	// Every replacement variable must be bound by the pattern.
+	used := make(map[string]bool)
+	isBound := func(v string) bool { return bases[v] != "" }
+	checkExpr := func(t token, text string) {
+		e, err := parseExpr(text)
+		if err == nil {
+			err = e.check()
+		}
+		if err != nil {
+			errorf("replacement %d:%d: %v", t.line, t.column, err)
+			return
+		}
+		e.vars(func(name string) {
+			v, ok := bases["$"+name]
+			if !ok {
+				errorf("replacement %d:%d: variable $%s used in %s is not bound by the pattern", t.line, t.column, name, text)
+				return
+			}
+			used[v] = true
+		})
+	}
+	checkRef := func(t token, ref string) {
+		if isAnonymous(ref) {
+			errorf("replacement %d:%d: anonymous variable %s cannot be used in the replacement", t.line, t.column, ref)
+			return
+		}
+		name, rest, ok := splitVarRef(ref, isBound)
+		if !ok || (rest == "" && t.ttype != WVAR && !bound[ref]) {
+			errorf("replacement %d:%d: variable %s is not bound by the pattern", t.line, t.column, ref)
+			return
+		}
+		used[bases[name]] = true
+		if rest != "" {
+			warnings = append(warnings, fmt.Sprintf("replacement %d:%d: %s is read as ${%s}%s", t.line, t.column, ref, name[1:], rest))
+		}
+	}
+	perNode(replacement, func(n *node) {
+		if n.children != nil {
+			return
+		}
+		t := n.token
+		switch t.ttype {
+		case EXPR:
+			checkExpr(t, t.text)
+		case WVAR:
+			for _, piece := range splitWord(t.text) {
+				if strings.HasPrefix(piece, "${") {
+					checkExpr(t, piece)
+				} else if piece[0] == '$' {
+					checkRef(t, piece)
+				}
+			}
+		case STRING:
+			pieces, isVar := splitString(t.text)
+			for i, piece := range pieces {
+				if !isVar[i] {
+					continue
+				}
+				if strings.HasPrefix(piece, "${") {
+					checkExpr(t, piece)
+				} else {
+					checkRef(t, piece)
+				}
+			}
+		case VAR:
+			checkRef(t, t.text)
+		case ALT:
+			errorf("replacement %d:%d: alternation %s can only be used in the pattern", t.line, t.column, t.text)
+		case RVAR:
+			used[t.text] = true
+			if isAnonymous(t.text) {
+				errorf("replacement %d:%d: anonymous variable %s cannot be used in the replacement", t.line, t.column, t.text)
+			} else if !bound[t.text] {
+				errorf("replacement %d:%d: variable %s is not bound by the pattern", t.line, t.column, t.text)
+			}
+		}
+	})
+
+	for _, t := range vars {
+		if !used[t.text] {
+			warnings = append(warnings, fmt.Sprintf("pattern %d:%d: variable %s is not used in the replacement", t.line, t.column, t.text))
+		}
+	}
+	return errs, warnings
+}
+
+// isVarName returns true iff s is a valid variable name such as $x.
+func isVarName(s string) bool {
+	if len(s) < 2 || s[0] != '$' {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isWordByte(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isSingleToken returns true iff text consists of exactly one token.
+func isSingleToken(text string) bool {
+	t := newTokenizer([]byte(text))
+	first := t.read()
+	return first.ttype != END && t.read().ttype == END &&
+		len(first.prefix)+len(first.suffix) == 0
+}
+
+// checkBrackets returns an error for every unbalanced bracket in tree n.
+// The tree is described as what in error messages.
+func checkBrackets(what string, n *node) []string {
+	var errs []string
+	var open []token // Stack of unclosed openers
+	perNode(n, func(c *node) {
+		if c.children != nil {
+			return
+		}
+		t := c.token
+		switch t.ttype {
+		case OPENER:
+			open = append(open, t)
+		case CLOSER:
+			if len(open) == 0 {
+				errs = append(errs, fmt.Sprintf("%s %d:%d: unbalanced %q", what, t.line, t.column, t.text))
+				return
+			}
+			top := open[len(open)-1]
+			open = open[:len(open)-1]
+			if closerFor(top.text) != t.text {
+				errs = append(errs, fmt.Sprintf("%s %d:%d: %q does not match %q at %d:%d", what, t.line, t.column, t.text, top.text, top.line, top.column))
+			}
+		}
+	})
+	for _, t := range open {
+		errs = append(errs, fmt.Sprintf("%s %d:%d: unclosed %q", what, t.line, t.column, t.text))
+	}
+	return errs
+}
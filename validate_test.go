@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	type test struct {
+		pattern     string
+		replacement string
+		errs        []string // Expected substrings of errors, in order
+		warnings    []string // Expected substrings of warnings, in order
+	}
+	for _, c := range []test{
+		{"f($a, $b)", "g($b, $a)", nil, nil},
+		{"f($a*)", "g($a*)", nil, nil},
+		{"", "x", []string{"pattern is empty"}, nil},
+		{"/* comment */", "x", []string{"pattern is empty"}, nil},
+		{"$a $b*", "$b* $a", nil, nil},
+		{"$a* $b*", "$b* $a*", []string{"only of repeated variables"}, nil},
+		{"$a+ $b?", "$b? $a+", nil, nil},
+		{"f($a{3,2})", "x", []string{"at least 3 but at most 2 times"}, []string{"not used"}},
+		{"f($a{2000})", "x", []string{"more than 1000 times"}, []string{"not used"}},
+		{"f($a+)", "${upper(a)}", nil, nil},
+		{"f($a)", "g($b)", []string{"1:3: variable $b is not bound"}, []string{"1:3: variable $a is not used"}},
+		{"f($a*)", "g($a)", []string{"variable $a is not bound"}, []string{"variable $a* is not used"}},
+		{"f($a, $b)", "g($a)", nil, []string{"variable $b is not used"}},
+		{"f($a", "g($a)", []string{`pattern 1:2: unclosed "("`}, nil},
+		{"f($a)", "g($a))", []string{`replacement 1:6: unbalanced ")"`}, nil},
+		{"get_$a()", "Get${camel(a)}()", nil, nil},
+		{"get_$a($b*)", "$a_getter($b*)", nil, []string{"1:1: $a_getter is read as ${a}_getter"}},
+		{"get_${a}_x()", "x_$a()", nil, nil},
+		{"get_${upper(a)}()", "x", []string{"${upper(a)} in get_${upper(a)} must be a variable name"}, nil},
+		{"get_$a()", "x_$b()", []string{"variable $b is not bound"}, []string{"variable $a is not used"}},
+		{"f($a*)", "${quote(a)}", nil, nil},
+		{"f($a)", "${upper(b)}", []string{"variable $b used in ${upper(b)} is not bound"}, []string{"variable $a is not used"}},
+		{"f($a)", "${frob(a)}", []string{"unknown function frob"}, []string{"variable $a is not used"}},
+		{"f($a)", "${trimprefix(a)}", []string{"trimprefix takes 2 arguments, not 1"}, []string{"variable $a is not used"}},
+		{"f($a)", "${upper(a}", []string{"missing )"}, []string{"variable $a is not used"}},
+		{"f(${a})", "x", []string{"can only be used in the replacement"}, nil},
+		{"$[malloc|calloc]($a*)", "alloc($a*)", nil, nil},
+		{"$f:[malloc|calloc]($a*)", "x_$f($a*)", nil, nil},
+		{"$f:[malloc|calloc]($a*)", "g($a*)", nil, []string{"variable $f is not used"}},
+		{"$[malloc|a b|]($a*)", "g($a*)", []string{`alternative "a b"`, `alternative ""`}, nil},
+		{"f($a)", "$[x|y]($a)", []string{"alternation $[x|y] can only be used in the pattern"}, nil},
+		{"memset($_, 0, sizeof($_))", "clear()", nil, nil},
+		{"f($_*, $_, $a)", "g($a)", nil, nil},
+		{"get_$_($a)", "g($a)", nil, nil},
+		{"f($_)", "g($_)", []string{"anonymous variable $_ cannot be used"}, nil},
+		{"f($_*)", "g($_*)", []string{"anonymous variable $_* cannot be used"}, nil},
+		{"f($a, $a)", "g($a)", []string{"1:7: variable $a is used more than once"}, nil},
+		{"f($a, $a*)", "g($a)", []string{"variable $a* is used more than once"}, nil},
+		{"f[$a)", "g($a)", []string{`pattern 1:5: ")" does not match "["`}, nil},
+		{`f("$a%lu")`, `g("$a%llu")`, nil, nil},
+		{`f("$a, $a")`, `g("$a")`, []string{"variable $a is used more than once"}, nil},
+		{`f("${upper(a)}")`, "x", []string{`${upper(a)} in "${upper(a)}" must be a variable name`}, nil},
+		{`f($a)`, `g("$b=${upper(a)}")`, []string{"variable $b is not bound"}, nil},
+		{`f("cost: $$5")`, `g("$$")`, nil, nil},
+	} {
+		errs, warnings := validate(parsePattern([]byte(c.pattern), ""), parsePattern([]byte(c.replacement), ""), nil)
+		check := func(what string, got, expect []string) {
+			if len(got) != len(expect) {
+				t.Errorf("Validate(%q, %q) %s:\nGot: %q\nExpect: %q\n", c.pattern, c.replacement, what, got, expect)
+				return
+			}
+			for i := range got {
+				if !strings.Contains(got[i], expect[i]) {
+					t.Errorf("Validate(%q, %q) %s:\nGot: %q\nExpect: %q\n", c.pattern, c.replacement, what, got[i], expect[i])
+				}
+			}
+		}
+		check("errors", errs, c.errs)
+		check("warnings", warnings, c.warnings)
+	}
+}